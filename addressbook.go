@@ -0,0 +1,110 @@
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// Location of the address book in the backup.
+const (
+	addressBookDomain = "HomeDomain"
+	addressBookPath   = "Library/AddressBook/AddressBook.sqlitedb"
+)
+
+// Address book multi-value properties.
+const (
+	abPhone = 3
+	abEmail = 4
+)
+
+var (
+	contactsOnce sync.Once
+	contactMap   map[string]string
+)
+
+// contactKey normalises a phone number or email address for matching.  Only the last ten
+// digits of phone numbers are kept, so numbers match with or without the country code.
+func contactKey(handle string) string {
+	if strings.Contains(handle, "@") {
+		return strings.ToLower(strings.TrimSpace(handle))
+	}
+
+	var digits []byte
+	for i := 0; i < len(handle); i++ {
+		if handle[i] >= '0' && handle[i] <= '9' {
+			digits = append(digits, handle[i])
+		}
+	}
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return string(digits)
+}
+
+// personName returns the name to show for a person in the address book.
+func personName(first, middle, last, org, nick string) string {
+	var parts []string
+	for _, p := range []string{first, middle, last} {
+		if p = strings.TrimSpace(p); p != "" {
+			parts = append(parts, p)
+		}
+	}
+	switch {
+	case len(parts) > 0:
+		return strings.Join(parts, " ")
+	case strings.TrimSpace(org) != "":
+		return strings.TrimSpace(org)
+	}
+	return strings.TrimSpace(nick)
+}
+
+// contactName returns the name of the person in the address book with the phone number or
+// email address handle, or handle itself if there is none.  The address book is read on
+// first use, and a missing address book is not an error.
+func contactName(root *DirNode, handle string) string {
+	contactsOnce.Do(func() {
+		contactMap = make(map[string]string)
+		if err := readContactNames(root); err != nil {
+			debug("Address book: %v", err)
+		}
+	})
+
+	if name, ok := contactMap[contactKey(handle)]; ok {
+		return name
+	}
+	return handle
+}
+
+func readContactNames(root *DirNode) error {
+	file, err := backupDB(root, addressBookDomain, addressBookPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.Query(`select coalesce(p.First,''), coalesce(p.Middle,''), coalesce(p.Last,''),
+		coalesce(p.Organization,''), coalesce(p.Nickname,''), coalesce(v.value,'')
+		from ABPerson p join ABMultiValue v on v.record_id = p.ROWID
+		where v.property in (?, ?)`, abPhone, abEmail)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var first, middle, last, org, nick, value string
+		if err := r.Scan(&first, &middle, &last, &org, &nick, &value); err != nil {
+			return err
+		}
+		if key := contactKey(value); key != "" {
+			if name := personName(first, middle, last, org, nick); name != "" {
+				contactMap[key] = name
+			}
+		}
+	}
+	return r.Err()
+}
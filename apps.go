@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"howett.net/plist"
+)
+
+// Top level directory presenting apps by name.
+const appsDir = "Apps"
+
+// app collects the domains belonging to an installed app.
+type app struct {
+	bundle  string
+	name    string
+	groups  []string
+	plugins []string
+}
+
+// readInfoPlist decodes Info.plist from the root of the backup.
+func readInfoPlist() (map[string]any, error) {
+	fh, err := global.src.Open("Info.plist")
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	info := make(map[string]any)
+	if err = plist.NewDecoder(fh).Decode(&info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// appNames returns the display names of the apps listed in Info.plist, keyed by bundle id.
+func appNames() map[string]string {
+	names := make(map[string]string)
+
+	info, err := readInfoPlist()
+	if err != nil {
+		debug("Info.plist: %v", err)
+		return names
+	}
+
+	apps, _ := info["Applications"].(map[string]any)
+	for bundle, a := range apps {
+		details, _ := a.(map[string]any)
+		data, ok := details["iTunesMetadata"].([]byte)
+		if !ok {
+			continue
+		}
+
+		meta := make(map[string]any)
+		if _, err := plist.Unmarshal(data, &meta); err != nil {
+			debug("%s: iTunesMetadata: %v", bundle, err)
+			continue
+		}
+		for _, key := range []string{"bundleDisplayName", "itemName", "playlistName"} {
+			if n, ok := meta[key].(string); ok && n != "" {
+				names[bundle] = n
+				break
+			}
+		}
+	}
+	return names
+}
+
+// commonPrefix counts the leading components shared by two dotted identifiers.
+func commonPrefix(a, b []string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// ownerOf finds the app an app group or plugin most likely belongs to, being the one whose
+// bundle id shares the most leading components with id beyond the vendor.  Plugins are named
+// after their app, while groups usually share the vendor and product part of the bundle id,
+// though not always the top level domain (eg: group.net.vendor.App.shared for com.vendor.App).
+// Sharing only the vendor (eg: group.com.apple.notes) is not enough, as vendors have many apps.
+func ownerOf(id string, apps []*app) *app {
+	var best *app
+	score := 0
+
+	parts := strings.Split(strings.TrimPrefix(id, "group."), ".")
+	for _, a := range apps {
+		bundle := strings.Split(a.bundle, ".")
+		n := commonPrefix(parts, bundle)
+		if n == len(bundle) {
+			// The whole bundle id, as for plugins
+			n = len(parts)
+		} else {
+			n -= 2
+			if len(parts) > 1 && len(bundle) > 1 {
+				if m := commonPrefix(parts[1:], bundle[1:]) - 1; m > n {
+					n = m
+				}
+			}
+		}
+		if n > score {
+			best, score = a, n
+		}
+	}
+	return best
+}
+
+// addAppsView adds Apps/<Display Name>/ holding each app's container, along with the app
+// group and plugin domains belonging to it.  Entries are shared with the domain directories.
+func addAppsView(root *DirNode) error {
+	domains, err := global.db.GetDomains()
+	if err != nil {
+		return err
+	}
+
+	names := appNames()
+	apps := make([]*app, 0, 100)
+	var others []Domain
+
+	for _, name := range domains {
+		if !selectDomain(name) {
+			continue
+		}
+		d := parseDomain(name)
+		switch d.Family {
+		case "AppDomain":
+			a := &app{bundle: d.ID, name: names[d.ID]}
+			if a.name == "" {
+				a.name = d.ID
+			}
+			apps = append(apps, a)
+		case "AppDomainGroup", "AppDomainPlugin":
+			others = append(others, d)
+		}
+	}
+
+	sort.Slice(apps, func(i, j int) bool { return apps[i].bundle < apps[j].bundle })
+	for _, d := range others {
+		a := ownerOf(d.ID, apps)
+		if a == nil {
+			debug("No app found for %s", d.Name)
+			continue
+		}
+		if d.Family == "AppDomainGroup" {
+			a.groups = append(a.groups, d.ID)
+		} else {
+			a.plugins = append(a.plugins, d.ID)
+		}
+	}
+
+	// Apps sharing a display name (once mapped) are told apart by bundle id
+	count := make(map[string]int)
+	for _, a := range apps {
+		count[safeName(a.name)]++
+	}
+
+	view := root.Subdir(appsDir, "")
+	for _, a := range apps {
+		name := safeName(a.name)
+		if count[name] > 1 {
+			name += " (" + safeName(a.bundle) + ")"
+		}
+		dir := view.Subdir(name, "AppDomain-"+a.bundle)
+
+		link := func(domain, parent, name string) {
+			src, ok := lookupPath(root, strings.Join(parseDomain(domain).Dirs(), "/")).(*DirNode)
+			if !ok {
+				return
+			}
+			if parent != "" {
+				dir.Subdir(parent, "").entries[name] = src.Alias(name)
+			} else {
+				dir.entries[name] = src.Alias(name)
+			}
+		}
+
+		link("AppDomain-"+a.bundle, "", "Container")
+		for _, g := range a.groups {
+			link("AppDomainGroup-"+g, "App Groups", g)
+		}
+		for _, p := range a.plugins {
+			link("AppDomainPlugin-"+p, "Plugins", p)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestOwnerOf(t *testing.T) {
+	var apps []*app
+	for _, b := range []string{
+		"com.apple.mobilenotes",
+		"com.apple.VoiceMemos",
+		"com.vendor.App",
+		"com.vendor.AppLite",
+		"com.whatsapp.WhatsApp",
+		"io.short",
+	} {
+		apps = append(apps, &app{bundle: b})
+	}
+
+	tests := []struct {
+		id   string
+		want string
+	}{
+		// Plugins are named after their app
+		{"com.whatsapp.WhatsApp.ShareExtension", "com.whatsapp.WhatsApp"},
+		{"com.vendor.AppLite.Widget", "com.vendor.AppLite"},
+		{"io.short.Widget", "io.short"},
+		// Groups share the vendor and product, though not always the top level domain
+		{"group.com.apple.VoiceMemos.shared", "com.apple.VoiceMemos"},
+		{"group.net.whatsapp.WhatsApp.shared", "com.whatsapp.WhatsApp"},
+		{"group.com.vendor.App", "com.vendor.App"},
+		{"group.com.vendor.App.shared", "com.vendor.App"},
+		// Sharing only the vendor is not enough
+		{"group.com.apple.notes", ""},
+		{"com.apple.Safari.Extension", ""},
+		{"group.com.vendor.Other", ""},
+		{"group.net.vendor", ""},
+		{"group.io.other", ""},
+		{"group.short", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if a := ownerOf(tt.id, apps); a != nil {
+			got = a.bundle
+		}
+		if got != tt.want {
+			t.Errorf("ownerOf(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
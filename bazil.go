@@ -76,7 +76,7 @@ func (f *FS) Root() (n fs.Node, err error) {
 func (f *FSDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	debug("DirNode:ReadDirAll Called")
 
-	e := f.NodeEntry.(*DirNode).entries
+	e := f.NodeEntry.(*DirNode).Entries()
 	r := make([]fuse.Dirent, len(e))
 
 	ri := 0
@@ -97,12 +97,12 @@ func (f *FSDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 
 func (f *FSDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
 	debug("DirNode:Lookup Called")
-	if v, ok := f.NodeEntry.(*DirNode).entries[req.Name]; ok {
+	if v := f.NodeEntry.(*DirNode).Lookup(req.Name); v != nil {
 		switch v.(type) {
-		case *FileNode:
-			return &FSFile{v}, nil
 		case *DirNode:
 			return &FSDir{v}, nil
+		case FileEntry:
+			return &FSFile{v}, nil
 		}
 	}
 	return nil, fuse.ENOENT
@@ -110,17 +110,16 @@ func (f *FSDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.
 
 func (f *FSFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	debug("FileNode:Open Called")
-	e := f.NodeEntry.(*FileNode)
-	file := e.Fullname()
+	e := f.NodeEntry.(FileEntry)
 
 	if !req.Flags.IsReadOnly() {
 		return nil, fuse.Errno(syscall.EACCES)
 	}
 
-	fh, err := os.Open(file)
+	fh, err := e.Open()
 	if err == nil {
 		//resp.Flags |= fuse.OpenDirectIO
-		return &FileHandle{fh: fh, inode: e.inode, id: e.id}, nil
+		return &FileHandle{fh: fh, inode: e.Inode(), id: e.ID()}, nil
 	}
 
 	return nil, err
@@ -128,18 +127,21 @@ func (f *FSFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.Ope
 
 func (f *FSFile) Attr(ctx context.Context, attr *fuse.Attr) error {
 	debug("FileNode:Attr Called")
-	file := f.NodeEntry.(*FileNode).Fullname()
-
-	if info, err := os.Stat(file); err == nil {
-		stat := info.Sys().(*syscall.Stat_t)
+	e := f.NodeEntry.(FileEntry)
 
+	if info, err := e.Stat(); err == nil {
 		attr.Mtime = info.ModTime()
-		attr.Atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
-		attr.Ctime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+		attr.Atime = attr.Mtime
+		attr.Ctime = attr.Mtime
+		// Files within an archive have no access or change times of their own
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			attr.Atime = time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+			attr.Ctime = time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec))
+		}
 		attr.Size = uint64(info.Size())
 		attr.Mode = info.Mode()
 	} else {
-		debug("Stat(%s) error: %v", file, err)
+		debug("Stat(%s) error: %v", e.Fullname(), err)
 		return err
 	}
 	return nil
@@ -174,13 +176,15 @@ func (f *FileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse
 	}
 
 	buf := make([]byte, req.Size)
-	n, err := f.fh.Read(buf)
+	n, err := io.ReadFull(f.fh, buf)
 	if err != nil {
 		if err == io.EOF {
 			return nil
 		}
-		return err
+		if err != io.ErrUnexpectedEOF {
+			return err
+		}
 	}
 	resp.Data = buf[:n]
-	return err
+	return nil
 }
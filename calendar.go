@@ -0,0 +1,568 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	// Time zone names are resolved without relying on the system's zone files (eg: on Windows)
+	_ "time/tzdata"
+)
+
+// Top level directory presenting the calendars as iCalendar files.
+const calendarsDir = "Calendars"
+
+// Location of the calendar database in the backup.
+const (
+	calendarDomain = "HomeDomain"
+	calendarPath   = "Library/Calendar/Calendar.sqlitedb"
+)
+
+// Calendar item types, where the database has an entity_type column.
+const calEvent = 2
+
+// Participant types.
+const (
+	calAttendee  = 7
+	calOrganizer = 8
+)
+
+// Recurrence frequencies, participant status and roles, and event status, indexed by their
+// value in the database.
+var (
+	calFrequency = []string{"", "DAILY", "WEEKLY", "MONTHLY", "YEARLY"}
+	calPartStat  = []string{"NEEDS-ACTION", "ACCEPTED", "DECLINED", "TENTATIVE"}
+	calRole      = []string{"REQ-PARTICIPANT", "REQ-PARTICIPANT", "OPT-PARTICIPANT", "CHAIR"}
+	calStatus    = []string{"", "CONFIRMED", "TENTATIVE", "CANCELLED"}
+)
+
+// Product identifier of the files, also used to make up missing uids.
+const calProduct = "iphonebackupfs"
+
+// Time zone of floating events, which happen at the same local time wherever you are.
+const calFloating = "_float"
+
+// event is a calendar item ready for writing.
+type event struct {
+	id             int64
+	uid            string
+	summary, desc  string
+	location, url  string
+	start, end     time.Time
+	startTZ, endTZ string
+	allDay         bool
+	status         int
+	stamp          time.Time
+	orig           int64
+	origDate       time.Time
+	rrule          string
+	exdates        []time.Time
+	alarms         []string
+	organizer      string
+	attendees      []string
+}
+
+// addCalendarsView adds Calendars/ holding an iCalendar file for each calendar.  The calendar
+// database is read when the directory is first opened, and each calendar when it is opened.
+func addCalendarsView(root *DirNode) error {
+	addViewDir(root, calendarsDir, func(d *DirNode) error {
+		return populateCalendars(root, d)
+	})
+	return nil
+}
+
+func populateCalendars(root, d *DirNode) error {
+	file, err := backupDB(root, calendarDomain, calendarPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.Query("select ROWID, coalesce(title,'') from Calendar order by ROWID")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var id int64
+		var title string
+		if err := r.Scan(&id, &title); err != nil {
+			return err
+		}
+		if title == "" {
+			title = "Calendar"
+		}
+		name := uniqueName(d, safeName(title)+".ics")
+		d.entries[name] = newVirtualWriter(name, calendarDomain, func(w io.Writer) error {
+			return writeCalendar(w, file, id, title)
+		})
+	}
+	return r.Err()
+}
+
+// readEvents reads the events of a calendar, along with their recurrences, alarms and
+// attendees.  Details held in tables missing from older versions are left out.
+func readEvents(db *sql.DB, calendar int64) ([]*event, error) {
+	where := "i.calendar_id = ?"
+	if hasColumn(db, "CalendarItem", "entity_type") {
+		where += fmt.Sprintf(" and i.entity_type = %d", calEvent)
+	}
+
+	r, err := db.Query(`select i.ROWID, `+columnOr(db, "CalendarItem", "unique_identifier", "''")+`,
+		coalesce(i.summary,''), coalesce(i.description,''), coalesce(l.title,''), coalesce(l.address,''),
+		`+columnOr(db, "CalendarItem", "url", "''")+`, coalesce(i.start_date,0), coalesce(i.start_tz,''),
+		coalesce(i.end_date,0), coalesce(i.end_tz,''), coalesce(i.all_day,0), coalesce(i.status,0),
+		`+columnOr(db, "CalendarItem", "last_modified", "0")+`, coalesce(i.orig_item_id,0), coalesce(i.orig_date,0)
+		from CalendarItem i left join Location l on l.ROWID = i.location_id
+		where `+where+` order by i.start_date, i.ROWID`, calendar)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var events []*event
+	byID := make(map[int64]*event)
+	for r.Next() {
+		var start, end, stamp, origDate float64
+		var addr string
+		e := &event{}
+		if err := r.Scan(&e.id, &e.uid, &e.summary, &e.desc, &e.location, &addr, &e.url, &start, &e.startTZ,
+			&end, &e.endTZ, &e.allDay, &e.status, &stamp, &e.orig, &origDate); err != nil {
+			return nil, err
+		}
+		if addr != "" && addr != e.location {
+			e.location = strings.TrimSpace(e.location + "\n" + addr)
+		}
+		if e.uid == "" {
+			e.uid = fmt.Sprintf("%d-%d@%s", calendar, e.id, calProduct)
+		}
+		e.start, e.end = appleTime(start), appleTime(end)
+		e.stamp = appleTime(stamp)
+		if stamp == 0 {
+			e.stamp = e.start
+		}
+		if e.orig != 0 {
+			e.origDate = appleTime(origDate)
+		}
+		events = append(events, e)
+		byID[e.id] = e
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	// Changed occurrences of a recurring event share its uid
+	for _, e := range events {
+		if m, ok := byID[e.orig]; ok {
+			e.uid = m.uid
+		}
+	}
+
+	items := "(select ROWID from CalendarItem i where " + where + ")"
+	readers := []func(*sql.DB, string, int64, map[int64]*event) error{
+		readRecurrences, readExceptions, readAlarms, readParticipants,
+	}
+	for _, read := range readers {
+		if err := read(db, items, calendar, byID); err != nil {
+			debug("Calendar %d: %v", calendar, err)
+		}
+	}
+	return events, nil
+}
+
+// readRecurrences sets the recurrence rule of each repeating event.  The specifier holds the
+// BYxxx parts, eg: "D=0MO,0WE" for every Monday and Wednesday or "D=-1FR;O=1,3" for the
+// last Friday in January and March.
+func readRecurrences(db *sql.DB, items string, calendar int64, byID map[int64]*event) error {
+	r, err := db.Query(`select owner_id, coalesce(frequency,0), coalesce(interval,1), coalesce(count,0),
+		coalesce(end_date,0), coalesce(specifier,'') from Recurrence where owner_id in `+items, calendar)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	parts := map[string]string{"D": "BYDAY", "M": "BYMONTHDAY", "O": "BYMONTH", "S": "BYSETPOS"}
+	for r.Next() {
+		var owner, count int64
+		var freq, interval int
+		var until float64
+		var spec string
+		if err := r.Scan(&owner, &freq, &interval, &count, &until, &spec); err != nil {
+			return err
+		}
+		e, ok := byID[owner]
+		if !ok || freq <= 0 || freq >= len(calFrequency) {
+			continue
+		}
+
+		rule := "FREQ=" + calFrequency[freq]
+		if interval > 1 {
+			rule += fmt.Sprintf(";INTERVAL=%d", interval)
+		}
+		switch {
+		case count > 0:
+			rule += fmt.Sprintf(";COUNT=%d", count)
+		case until != 0 && e.allDay:
+			rule += ";UNTIL=" + appleTime(until).UTC().Format("20060102")
+		case until != 0:
+			rule += ";UNTIL=" + appleTime(until).UTC().Format("20060102T150405Z")
+		}
+		for _, s := range strings.Split(spec, ";") {
+			k, v, ok := strings.Cut(s, "=")
+			if !ok || parts[k] == "" {
+				continue
+			}
+			if k == "D" {
+				days := strings.Split(v, ",")
+				for i := range days {
+					days[i] = strings.TrimPrefix(strings.TrimPrefix(days[i], "+"), "0")
+				}
+				v = strings.Join(days, ",")
+			}
+			rule += ";" + parts[k] + "=" + v
+		}
+		e.rrule = rule
+	}
+	return r.Err()
+}
+
+// readExceptions adds the deleted occurrences of repeating events.
+func readExceptions(db *sql.DB, items string, calendar int64, byID map[int64]*event) error {
+	r, err := db.Query("select owner_id, date from ExceptionDate where owner_id in "+items, calendar)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var owner int64
+		var date float64
+		if err := r.Scan(&owner, &date); err != nil {
+			return err
+		}
+		if e, ok := byID[owner]; ok {
+			e.exdates = append(e.exdates, appleTime(date))
+		}
+	}
+	return r.Err()
+}
+
+// readAlarms adds the alarms of each event, which are relative to the start of the event or
+// at a fixed time.
+func readAlarms(db *sql.DB, items string, calendar int64, byID map[int64]*event) error {
+	owner := "calendaritem_owner_id"
+	if !hasColumn(db, "Alarm", owner) {
+		owner = "owner_id"
+	}
+	r, err := db.Query("select "+owner+", coalesce(trigger_interval,0), coalesce(trigger_date,0) from Alarm where "+owner+" in "+items, calendar)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var id, interval int64
+		var date float64
+		if err := r.Scan(&id, &interval, &date); err != nil {
+			return err
+		}
+		e, ok := byID[id]
+		if !ok {
+			continue
+		}
+		if date != 0 {
+			e.alarms = append(e.alarms, "TRIGGER;VALUE=DATE-TIME:"+appleTime(date).UTC().Format("20060102T150405Z"))
+		} else {
+			e.alarms = append(e.alarms, "TRIGGER:"+icsDuration(interval))
+		}
+	}
+	return r.Err()
+}
+
+// readParticipants adds the organizer and attendees of each event.
+func readParticipants(db *sql.DB, items string, calendar int64, byID map[int64]*event) error {
+	name, addr, join := "''", "''", ""
+	if hasColumn(db, "Identity", "display_name") {
+		name, addr = "coalesce(n.display_name,'')", "coalesce(n.address,'')"
+		join = "left join Identity n on n.ROWID = p.identity_id"
+	}
+	r, err := db.Query(`select p.owner_id, coalesce(p.entity_type,0), coalesce(p.status,0), coalesce(p.role,0),
+		coalesce(p.email,''), `+name+`, `+addr+` from Participant p `+join+`
+		where p.owner_id in `+items+` order by p.ROWID`, calendar)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var owner int64
+		var kind, status, role int
+		var email, cn, address string
+		if err := r.Scan(&owner, &kind, &status, &role, &email, &cn, &address); err != nil {
+			return err
+		}
+		e, ok := byID[owner]
+		if !ok {
+			continue
+		}
+		if email == "" {
+			email = strings.TrimPrefix(address, "mailto:")
+		}
+		if email == "" {
+			continue
+		}
+
+		params := ""
+		if cn != "" {
+			params += ";CN=" + icsParam(cn)
+		}
+		switch kind {
+		case calOrganizer:
+			e.organizer = "ORGANIZER" + params + ":mailto:" + email
+		case calAttendee:
+			if status >= 0 && status < len(calPartStat) {
+				params += ";PARTSTAT=" + calPartStat[status]
+			}
+			if role >= 0 && role < len(calRole) {
+				params += ";ROLE=" + calRole[role]
+			}
+			e.attendees = append(e.attendees, "ATTENDEE"+params+":mailto:"+email)
+		}
+	}
+	return r.Err()
+}
+
+// icsParam quotes a parameter value if needed.  Quotes cannot be escaped, so are removed.
+func icsParam(v string) string {
+	v = strings.ReplaceAll(v, `"`, "")
+	if strings.ContainsAny(v, ":;,") {
+		return `"` + v + `"`
+	}
+	return v
+}
+
+// icsDuration formats seconds as an iCalendar duration, eg: -900 gives "-PT15M".
+func icsDuration(secs int64) string {
+	sign := ""
+	if secs < 0 {
+		sign, secs = "-", -secs
+	}
+	if secs == 0 {
+		return "PT0S"
+	}
+
+	d := sign + "P"
+	if days := secs / 86400; days > 0 {
+		d += fmt.Sprintf("%dD", days)
+	}
+	if secs %= 86400; secs > 0 {
+		d += "T"
+		if h := secs / 3600; h > 0 {
+			d += fmt.Sprintf("%dH", h)
+		}
+		if m := secs % 3600 / 60; m > 0 {
+			d += fmt.Sprintf("%dM", m)
+		}
+		if s := secs % 60; s > 0 {
+			d += fmt.Sprintf("%dS", s)
+		}
+	}
+	return d
+}
+
+// icsTime formats a date property of an event, in its time zone.  Zones which are used are
+// added to zones, so they can be described in the file.
+func icsTime(name string, t time.Time, tz string, allDay bool, zones map[string]*time.Location) string {
+	switch {
+	case allDay:
+		return name + ";VALUE=DATE:" + t.UTC().Format("20060102")
+	case tz == calFloating:
+		return name + ":" + t.UTC().Format("20060102T150405")
+	case tz == "" || tz == "UTC" || tz == "GMT":
+		return name + ":" + t.UTC().Format("20060102T150405Z")
+	}
+
+	loc, ok := zones[tz]
+	if !ok {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			debug("Time zone %s: %v", tz, err)
+			return name + ":" + t.UTC().Format("20060102T150405Z")
+		}
+		zones[tz] = loc
+	}
+	return name + ";TZID=" + tz + ":" + t.In(loc).Format("20060102T150405")
+}
+
+// icsOffset formats a UTC offset in seconds, eg: "+0100".
+func icsOffset(secs int) string {
+	sign := "+"
+	if secs < 0 {
+		sign, secs = "-", -secs
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, secs/3600, secs%3600/60)
+}
+
+// writeTimezone describes a time zone by its changes between the start of year from and the
+// end of year to, found by checking the offset each day.
+func writeTimezone(line func(string), loc *time.Location, from, to int) {
+	line("BEGIN:VTIMEZONE")
+	line("TZID:" + loc.String())
+
+	observance := func(at time.Time, from, to int) {
+		kind := "STANDARD"
+		if at.In(loc).IsDST() {
+			kind = "DAYLIGHT"
+		}
+		name, _ := at.In(loc).Zone()
+		line("BEGIN:" + kind)
+		line("DTSTART:" + at.In(time.FixedZone("", from)).Format("20060102T150405"))
+		line("TZOFFSETFROM:" + icsOffset(from))
+		line("TZOFFSETTO:" + icsOffset(to))
+		line("TZNAME:" + contentEscape(name))
+		line("END:" + kind)
+	}
+
+	t := time.Date(from, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(to+1, 1, 1, 0, 0, 0, 0, loc)
+	_, offset := t.Zone()
+	changes := 0
+	for t.Before(end) {
+		next := t.Add(24 * time.Hour)
+		if _, o := next.Zone(); o != offset {
+			// The change is in this day, so find the second it happens
+			lo, hi := t.Unix(), next.Unix()
+			for hi-lo > 1 {
+				mid := lo + (hi-lo)/2
+				if _, o := time.Unix(mid, 0).In(loc).Zone(); o == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			observance(time.Unix(hi, 0), offset, o)
+			offset = o
+			changes++
+		}
+		t = next
+	}
+	if changes == 0 {
+		observance(time.Date(1970, 1, 1, 0, 0, 0, 0, loc), offset, offset)
+	}
+	line("END:VTIMEZONE")
+}
+
+// writeCalendar writes the calendar as an iCalendar file.
+func writeCalendar(w io.Writer, file string, calendar int64, title string) error {
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	events, err := readEvents(db, calendar)
+	if err != nil {
+		return err
+	}
+
+	// Events are written first, to find the time zones to describe
+	var body strings.Builder
+	line := func(s string) { contentLine(&body, s) }
+	zones := make(map[string]*time.Location)
+	from, to := time.Now().Year(), time.Now().Year()+1
+
+	for _, e := range events {
+		if y := e.start.Year(); y < from {
+			from = y
+		}
+		if y := e.start.Year(); y > to {
+			to = y
+		}
+
+		line("BEGIN:VEVENT")
+		line("UID:" + contentEscape(e.uid))
+		line("DTSTAMP:" + e.stamp.UTC().Format("20060102T150405Z"))
+		line(icsTime("DTSTART", e.start, e.startTZ, e.allDay, zones))
+		if e.allDay {
+			// The end is stored as the last second of the event, but is exclusive in iCalendar
+			end := e.end.Add(12 * time.Hour).UTC().Truncate(24 * time.Hour)
+			if !end.After(e.start) {
+				end = e.start.Add(24 * time.Hour)
+			}
+			line(icsTime("DTEND", end, e.endTZ, true, zones))
+		} else if !e.end.Before(e.start) {
+			tz := e.endTZ
+			if tz == "" {
+				tz = e.startTZ
+			}
+			line(icsTime("DTEND", e.end, tz, false, zones))
+		}
+		if e.orig != 0 {
+			line(icsTime("RECURRENCE-ID", e.origDate, e.startTZ, e.allDay, zones))
+		}
+		if e.rrule != "" {
+			line("RRULE:" + e.rrule)
+		}
+		sort.Slice(e.exdates, func(i, j int) bool { return e.exdates[i].Before(e.exdates[j]) })
+		for _, x := range e.exdates {
+			line(icsTime("EXDATE", x, e.startTZ, e.allDay, zones))
+		}
+		line("SUMMARY:" + contentEscape(e.summary))
+		if e.location != "" {
+			line("LOCATION:" + contentEscape(e.location))
+		}
+		if e.desc != "" {
+			line("DESCRIPTION:" + contentEscape(e.desc))
+		}
+		if e.url != "" {
+			line("URL:" + e.url)
+		}
+		if e.status > 0 && e.status < len(calStatus) {
+			line("STATUS:" + calStatus[e.status])
+		}
+		if e.organizer != "" {
+			line(e.organizer)
+		}
+		for _, a := range e.attendees {
+			line(a)
+		}
+		for _, a := range e.alarms {
+			line("BEGIN:VALARM")
+			line("ACTION:DISPLAY")
+			line("DESCRIPTION:" + contentEscape(e.summary))
+			line(a)
+			line("END:VALARM")
+		}
+		line("END:VEVENT")
+	}
+
+	var b strings.Builder
+	line = func(s string) { contentLine(&b, s) }
+	line("BEGIN:VCALENDAR")
+	line("VERSION:2.0")
+	line("PRODID:-//" + calProduct + "//Calendar Export//EN")
+	line("CALSCALE:GREGORIAN")
+	line("X-WR-CALNAME:" + contentEscape(title))
+
+	names := make([]string, 0, len(zones))
+	for tz := range zones {
+		names = append(names, tz)
+	}
+	sort.Strings(names)
+	for _, tz := range names {
+		writeTimezone(line, zones[tz], from, to)
+	}
+	b.WriteString(body.String())
+	line("END:VCALENDAR")
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestICSParam(t *testing.T) {
+	tests := []struct {
+		v    string
+		want string
+	}{
+		{"John Smith", "John Smith"},
+		{"Smith, John", `"Smith, John"`},
+		{"a;b:c", `"a;b:c"`},
+		{`The "Boss"`, "The Boss"},
+	}
+	for _, tt := range tests {
+		if got := icsParam(tt.v); got != tt.want {
+			t.Errorf("icsParam(%q) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestICSDuration(t *testing.T) {
+	tests := []struct {
+		secs int64
+		want string
+	}{
+		{0, "PT0S"},
+		{-900, "-PT15M"},
+		{3600, "PT1H"},
+		{5430, "PT1H30M30S"},
+		{86400, "P1D"},
+		{-2*86400 - 7200, "-P2DT2H"},
+		{45, "PT45S"},
+	}
+	for _, tt := range tests {
+		if got := icsDuration(tt.secs); got != tt.want {
+			t.Errorf("icsDuration(%d) = %q, want %q", tt.secs, got, tt.want)
+		}
+	}
+}
+
+func TestICSOffset(t *testing.T) {
+	tests := []struct {
+		secs int
+		want string
+	}{
+		{0, "+0000"},
+		{3600, "+0100"},
+		{-18000, "-0500"},
+		{19800, "+0530"},
+		{-12600, "-0330"},
+	}
+	for _, tt := range tests {
+		if got := icsOffset(tt.secs); got != tt.want {
+			t.Errorf("icsOffset(%d) = %q, want %q", tt.secs, got, tt.want)
+		}
+	}
+}
+
+func TestICSTime(t *testing.T) {
+	at := time.Date(2020, 7, 1, 22, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		tz     string
+		allDay bool
+		want   string
+		zone   bool
+	}{
+		{"Europe/London", true, "DTSTART;VALUE=DATE:20200701", false},
+		{calFloating, false, "DTSTART:20200701T223000", false},
+		{"", false, "DTSTART:20200701T223000Z", false},
+		{"GMT", false, "DTSTART:20200701T223000Z", false},
+		{"Europe/London", false, "DTSTART;TZID=Europe/London:20200701T233000", true},
+		{"America/New_York", false, "DTSTART;TZID=America/New_York:20200701T183000", true},
+		{"Not/A_Zone", false, "DTSTART:20200701T223000Z", false},
+	}
+	for _, tt := range tests {
+		zones := make(map[string]*time.Location)
+		if got := icsTime("DTSTART", at, tt.tz, tt.allDay, zones); got != tt.want {
+			t.Errorf("icsTime(%q, %v) = %q, want %q", tt.tz, tt.allDay, got, tt.want)
+		}
+		if _, zone := zones[tt.tz]; zone != tt.zone {
+			t.Errorf("icsTime(%q, %v): zone added = %v, want %v", tt.tz, tt.allDay, zone, tt.zone)
+		}
+	}
+}
+
+func TestWriteTimezone(t *testing.T) {
+	tests := []struct {
+		tz   string
+		want string
+	}{
+		{"Europe/London", `BEGIN:VTIMEZONE
+TZID:Europe/London
+BEGIN:DAYLIGHT
+DTSTART:20200329T010000
+TZOFFSETFROM:+0000
+TZOFFSETTO:+0100
+TZNAME:BST
+END:DAYLIGHT
+BEGIN:STANDARD
+DTSTART:20201025T020000
+TZOFFSETFROM:+0100
+TZOFFSETTO:+0000
+TZNAME:GMT
+END:STANDARD
+END:VTIMEZONE
+`},
+		{"Asia/Tokyo", `BEGIN:VTIMEZONE
+TZID:Asia/Tokyo
+BEGIN:STANDARD
+DTSTART:19700101T000000
+TZOFFSETFROM:+0900
+TZOFFSETTO:+0900
+TZNAME:JST
+END:STANDARD
+END:VTIMEZONE
+`},
+	}
+	for _, tt := range tests {
+		loc, err := time.LoadLocation(tt.tz)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		writeTimezone(func(s string) { b.WriteString(s + "\n") }, loc, 2020, 2020)
+		if b.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.tz, b.String(), tt.want)
+		}
+	}
+}
+
+func TestReadRecurrences(t *testing.T) {
+	file := testDB(t,
+		"create table CalendarItem (ROWID integer primary key, calendar_id integer)",
+		"create table Recurrence (owner_id integer, frequency integer, interval integer, count integer, end_date real, specifier text)",
+		"insert into CalendarItem values (1, 1), (2, 1), (3, 1), (4, 1), (5, 1), (6, 1), (7, 1), (8, 2)",
+		"insert into Recurrence values (1, 2, 1, 0, null, 'D=0MO,0WE')",
+		"insert into Recurrence values (2, 3, 2, 5, null, 'D=-1FR;O=1,3')",
+		"insert into Recurrence values (3, 1, null, null, 600000000, null)",
+		"insert into Recurrence values (4, 4, 1, 0, 600000000, '')",
+		"insert into Recurrence values (5, 0, 1, 0, null, null)",
+		"insert into Recurrence values (6, 9, 1, 0, null, null)",
+		"insert into Recurrence values (7, 3, 1, 0, null, 'D=+1MO;X=5;M=15;S=-1')",
+		"insert into Recurrence values (8, 1, 1, 0, null, null)",
+	)
+	db, err := openSQLite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		id     int64
+		allDay bool
+		want   string
+	}{
+		{1, false, "FREQ=WEEKLY;BYDAY=MO,WE"},
+		{2, false, "FREQ=MONTHLY;INTERVAL=2;COUNT=5;BYDAY=-1FR;BYMONTH=1,3"},
+		{3, false, "FREQ=DAILY;UNTIL=20200106T104000Z"},
+		{4, true, "FREQ=YEARLY;UNTIL=20200106"},
+		{5, false, ""},
+		{6, false, ""},
+		{7, false, "FREQ=MONTHLY;BYDAY=1MO;BYMONTHDAY=15;BYSETPOS=-1"},
+		{8, false, ""},
+	}
+	byID := make(map[int64]*event)
+	for _, tt := range tests {
+		byID[tt.id] = &event{id: tt.id, allDay: tt.allDay}
+	}
+	items := "(select ROWID from CalendarItem where calendar_id = ?)"
+	if err := readRecurrences(db, items, 1, byID); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		if got := byID[tt.id].rrule; got != tt.want {
+			t.Errorf("%d: got %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
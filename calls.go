@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"io"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Top level directory holding the call log.
+const callsDir = "Call History"
+
+// Location of the call log in the backup, and of the one used before iOS 8.
+const (
+	callsDomain       = "HomeDomain"
+	callsPath         = "Library/CallHistoryDB/CallHistory.storedata"
+	legacyCallsDomain = "WirelessDomain"
+	legacyCallsPath   = "Library/CallHistory/call_history.db"
+)
+
+// Call types, and the services of the built in apps.
+const (
+	callFaceTimeVideo = 8
+	callFaceTimeAudio = 16
+
+	serviceTelephony = "com.apple.Telephony"
+	serviceFaceTime  = "com.apple.FaceTime"
+)
+
+// Flags of calls in the legacy call log.
+const (
+	legacyOutgoing = 1
+	legacyFaceTime = 16
+)
+
+// CallRecord is a call from the call log.
+type CallRecord struct {
+	Date      time.Time `json:"date"`
+	Number    string    `json:"number"`
+	Name      string    `json:"name"`
+	Direction string    `json:"direction"`
+	Duration  float64   `json:"duration"`
+	Service   string    `json:"service"`
+}
+
+func (r *CallRecord) csvHeader() []string {
+	return []string{"date", "number", "name", "direction", "duration", "service"}
+}
+
+func (r *CallRecord) csvRow() []string {
+	return []string{r.Date.Format(time.RFC3339), r.Number, r.Name, r.Direction,
+		strconv.FormatFloat(r.Duration, 'f', -1, 64), r.Service}
+}
+
+// callDirection describes the direction of a call.
+func callDirection(outgoing, answered bool) string {
+	switch {
+	case outgoing:
+		return "outgoing"
+	case answered:
+		return "incoming"
+	}
+	return "missed"
+}
+
+// callerName returns the name of the person with the number in the address book, if any.
+func callerName(root *DirNode, number string) string {
+	if name := contactName(root, number); name != number {
+		return name
+	}
+	return ""
+}
+
+// addCallsView adds "Call History/" holding the call log as CSV and JSON, generated when
+// first opened.
+func addCallsView(root *DirNode) error {
+	addViewDir(root, callsDir, func(d *DirNode) error {
+		for _, format := range []string{formatCSV, formatJSON} {
+			name, format := "calls."+format, format
+			d.entries[name] = newVirtualWriter(name, callsDomain, func(w io.Writer) error {
+				return writeCalls(root, format, w)
+			})
+		}
+		return nil
+	})
+	return nil
+}
+
+// writeCalls writes the call log, newest first.  The legacy call log is only used when the
+// backup has no current one, as upgraded devices may hold both.
+func writeCalls(root *DirNode, format string, w io.Writer) error {
+	calls, err := readCalls(root)
+	if err != nil {
+		legacy, lerr := readLegacyCalls(root)
+		if lerr != nil {
+			return err
+		}
+		calls = legacy
+	}
+	sort.SliceStable(calls, func(i, j int) bool { return calls[i].Date.After(calls[j].Date) })
+
+	rw := newRecordWriter(w, format)
+	for _, c := range calls {
+		if err := rw.Write(c); err != nil {
+			return err
+		}
+	}
+	return rw.Close()
+}
+
+// readCalls reads the Core Data call log.  Calls through other apps name the app providing
+// the service.
+func readCalls(root *DirNode) ([]*CallRecord, error) {
+	file, err := backupDB(root, callsDomain, callsPath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	r, err := db.Query(`select ZADDRESS, coalesce(ZDATE,0), coalesce(ZDURATION,0), coalesce(ZORIGINATED,0),
+		coalesce(ZANSWERED,0), coalesce(ZCALLTYPE,0), ` + columnOr(db, "ZCALLRECORD", "ZSERVICE_PROVIDER", "''") + `,
+		` + columnOr(db, "ZCALLRECORD", "ZNAME", "''") + ` from ZCALLRECORD`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	apps := appNames()
+	var calls []*CallRecord
+	for r.Next() {
+		var address sql.RawBytes
+		var date, duration float64
+		var outgoing, answered bool
+		var kind int
+		var provider, name string
+		if err := r.Scan(&address, &date, &duration, &outgoing, &answered, &kind, &provider, &name); err != nil {
+			return nil, err
+		}
+
+		c := &CallRecord{
+			Date:      appleTime(date),
+			Number:    string(address),
+			Direction: callDirection(outgoing, answered),
+			Duration:  duration,
+		}
+		if c.Name = name; c.Name == "" {
+			c.Name = callerName(root, c.Number)
+		}
+
+		switch {
+		case kind == callFaceTimeVideo:
+			c.Service = "FaceTime Video"
+		case kind == callFaceTimeAudio:
+			c.Service = "FaceTime Audio"
+		case provider == "" || provider == serviceTelephony:
+			c.Service = "Phone"
+		case provider == serviceFaceTime:
+			c.Service = "FaceTime"
+		case apps[provider] != "":
+			c.Service = apps[provider]
+		default:
+			c.Service = provider
+		}
+		calls = append(calls, c)
+	}
+	return calls, r.Err()
+}
+
+// readLegacyCalls reads the call log of iOS 7 and earlier.
+func readLegacyCalls(root *DirNode) ([]*CallRecord, error) {
+	file, err := backupDB(root, legacyCallsDomain, legacyCallsPath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	r, err := db.Query("select coalesce(address,''), coalesce(date,0), coalesce(duration,0), coalesce(flags,0) from call")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var calls []*CallRecord
+	for r.Next() {
+		var address string
+		var date int64
+		var duration float64
+		var flags int
+		if err := r.Scan(&address, &date, &duration, &flags); err != nil {
+			return nil, err
+		}
+
+		c := &CallRecord{
+			Date:      time.Unix(date, 0).UTC(),
+			Number:    address,
+			Name:      callerName(root, address),
+			Direction: callDirection(flags&legacyOutgoing != 0, duration > 0),
+			Duration:  duration,
+			Service:   "Phone",
+		}
+		if flags&legacyFaceTime != 0 {
+			c.Service = "FaceTime"
+		}
+		calls = append(calls, c)
+	}
+	return calls, r.Err()
+}
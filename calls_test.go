@@ -0,0 +1,107 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCallDirection(t *testing.T) {
+	tests := []struct {
+		outgoing, answered bool
+		want               string
+	}{
+		{true, true, "outgoing"},
+		{true, false, "outgoing"},
+		{false, true, "incoming"},
+		{false, false, "missed"},
+	}
+	for _, tt := range tests {
+		if got := callDirection(tt.outgoing, tt.answered); got != tt.want {
+			t.Errorf("callDirection(%v, %v) = %q, want %q", tt.outgoing, tt.answered, got, tt.want)
+		}
+	}
+}
+
+func TestCallRow(t *testing.T) {
+	r := &CallRecord{
+		Date:      time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC),
+		Number:    "+15550100",
+		Name:      "John Smith",
+		Direction: "incoming",
+		Duration:  61.5,
+		Service:   "FaceTime Audio",
+	}
+	want := []string{"2020-01-06T10:40:00Z", "+15550100", "John Smith", "incoming", "61.5", "FaceTime Audio"}
+	if got := r.csvRow(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if len(r.csvHeader()) != len(want) {
+		t.Errorf("%d columns in header, %d in rows", len(r.csvHeader()), len(want))
+	}
+}
+
+func TestContactKey(t *testing.T) {
+	tests := []struct {
+		handle string
+		want   string
+	}{
+		{"+1 (555) 010-0123", "5550100123"},
+		{"555-010-0123", "5550100123"},
+		{"+44 7700 900123", "7700900123"},
+		{"12345", "12345"},
+		{" John@Example.COM ", "john@example.com"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := contactKey(tt.handle); got != tt.want {
+			t.Errorf("contactKey(%q) = %q, want %q", tt.handle, got, tt.want)
+		}
+	}
+}
+
+func TestPersonName(t *testing.T) {
+	tests := []struct {
+		first, middle, last, org, nick string
+		want                           string
+	}{
+		{"John", "Q", "Smith", "Acme", "Johnny", "John Q Smith"},
+		{" John ", "", "", "", "", "John"},
+		{"", "", "Smith", "", "", "Smith"},
+		{"", "", "", " Acme ", "Johnny", "Acme"},
+		{"", "", "", "", "Johnny", "Johnny"},
+		{"", " ", "", "", "", ""},
+	}
+	for _, tt := range tests {
+		if got := personName(tt.first, tt.middle, tt.last, tt.org, tt.nick); got != tt.want {
+			t.Errorf("personName(%q, %q, %q, %q, %q) = %q, want %q",
+				tt.first, tt.middle, tt.last, tt.org, tt.nick, got, tt.want)
+		}
+	}
+}
+
+func TestCallerName(t *testing.T) {
+	contactsOnce.Do(func() {})
+	saved := contactMap
+	defer func() { contactMap = saved }()
+	contactMap = map[string]string{
+		"5550100123":       "John Smith",
+		"john@example.com": "John Smith",
+	}
+
+	tests := []struct {
+		number string
+		want   string
+	}{
+		{"+15550100123", "John Smith"},
+		{"(555) 010-0123", "John Smith"},
+		{"John@example.com", "John Smith"},
+		{"+15550100999", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := callerName(nil, tt.number); got != tt.want {
+			t.Errorf("callerName(%q) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// command is a subcommand which inspects a backup without mounting it.  Commands which
+// need the listing operate on the same tree that would be mounted, so the -A, -d and -l
+// options apply to them too.
+type command struct {
+	name    string
+	args    string
+	help    string
+	listing bool
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"ls", "[path...]", "List directory contents with sizes and dates.", true, cmdLs},
+	{"stat", "<path...>", "Show the manifest metadata of files.", true, cmdStat},
+	{"cat", "<path...>", "Write the contents of files to stdout.", true, cmdCat},
+	{"tree", "[path]", "Show the directory tree.", true, cmdTree},
+	{"du", "[domain...]", "Show space used by each domain (and directory with -depth).", false, cmdDu},
+	{"query", "<domain>/<path> <sql>", "Run SQL against a database in the backup.", false, cmdQuery},
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// openTree opens the backup and, if needed, reads the listing as done before mounting.
+func openTree(listing bool) error {
+	if err := openDB(); err != nil {
+		return err
+	}
+	if !listing {
+		return nil
+	}
+
+	root, err := global.db.ReadListing()
+	if err != nil {
+		return err
+	}
+	global.FSRoot = root
+	return nil
+}
+
+// findPath locates path in the tree, returning an error suitable for display if missing.
+func findPath(p string) (NodeEntry, error) {
+	if e := lookupPath(global.FSRoot, p); e != nil {
+		return e, nil
+	}
+	return nil, fmt.Errorf("%s: no such file or directory", p)
+}
+
+// listDomains writes the domain summary for -L when a machine readable format is selected.
+func listDomains() error {
+	stats, err := global.db.GetDomainStats()
+	if err != nil {
+		return err
+	}
+
+	rw := newRecordWriter(os.Stdout, global.Format)
+	for _, s := range stats {
+		if err := rw.Write(s); err != nil {
+			return err
+		}
+	}
+	return rw.Close()
+}
+
+// writeRecords writes a record for e (found at p) and, if recurse is set, everything below it.
+func writeRecords(rw *recordWriter, p string, e NodeEntry, recurse bool) error {
+	r, err := newFileRecord(p, e)
+	if err != nil {
+		return err
+	}
+	if err = rw.Write(r); err != nil {
+		return err
+	}
+
+	if dir, ok := e.(*DirNode); ok && recurse {
+		for _, n := range dir.Names() {
+			if err := writeRecords(rw, path.Join(p, n), dir.entries[n], true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func cmdLs(args []string) error {
+	if len(args) == 0 {
+		args = []string{""}
+	}
+
+	if global.Format != formatText {
+		rw := newRecordWriter(os.Stdout, global.Format)
+		for _, p := range args {
+			e, err := findPath(p)
+			if err != nil {
+				return err
+			}
+			dir, ok := e.(*DirNode)
+			if !ok {
+				if err := writeRecords(rw, p, e, false); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, n := range dir.Names() {
+				if err := writeRecords(rw, path.Join(p, n), dir.entries[n], false); err != nil {
+					return err
+				}
+			}
+		}
+		return rw.Close()
+	}
+
+	w := os.Stdout
+	for i, p := range args {
+		e, err := findPath(p)
+		if err != nil {
+			return err
+		}
+
+		dir, ok := e.(*DirNode)
+		if !ok {
+			if err := lsEntry(w, path.Base(p), e); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if len(args) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			if p == "" {
+				p = "."
+			}
+			fmt.Fprintf(w, "%s:\n", p)
+		}
+		for _, n := range dir.Names() {
+			if err := lsEntry(w, n, dir.entries[n]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func lsEntry(w io.Writer, name string, e NodeEntry) error {
+	if dir, ok := e.(*DirNode); ok {
+		fmt.Fprintf(w, "drwxr-xr-x %12d %-16s %s/\n", len(dir.Entries()), "-", name)
+		return nil
+	}
+
+	if v, ok := e.(*VirtualNode); ok {
+		info, err := v.Stat()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s %12d %-16s %s\n", info.Mode(), info.Size(), info.ModTime().Format("2006-01-02 15:04"), name)
+		return nil
+	}
+
+	m, err := global.db.GetFile(e.ID())
+	if err != nil {
+		return err
+	}
+	f := m.File
+	mtime := f.LastModified
+	if file, ok := e.(*FileNode); ok && !file.mtime.IsZero() {
+		mtime = file.mtime
+	}
+	fmt.Fprintf(w, "%s %12d %-16s %s\n", f.FileMode(), f.Size, mtime.Format("2006-01-02 15:04"), name)
+	return nil
+}
+
+func cmdStat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("stat: path required")
+	}
+
+	for i, p := range args {
+		e, err := findPath(p)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+
+		if dir, ok := e.(*DirNode); ok {
+			fmt.Printf("Path: %s\n", p)
+			fmt.Printf("Type: directory\n")
+			fmt.Printf("Domain: %s\n", dir.Domain())
+			fmt.Printf("Entries: %d\n", len(dir.Entries()))
+			continue
+		}
+
+		if v, ok := e.(*VirtualNode); ok {
+			info, err := v.Stat()
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Path: %s\n", p)
+			fmt.Printf("Type: generated file\n")
+			fmt.Printf("Domain: %s\n", v.Domain())
+			fmt.Printf("Size: %d\n", info.Size())
+			continue
+		}
+
+		m, err := global.db.GetFile(e.ID())
+		if err != nil {
+			return err
+		}
+		f := m.File
+
+		fmt.Printf("Path: %s\n", p)
+		fmt.Printf("Type: file\n")
+		fmt.Printf("FileID: %s\n", m.ID)
+		fmt.Printf("Domain: %s\n", m.Domain)
+		fmt.Printf("RelativePath: %s\n", m.RelativePath)
+		fmt.Printf("Flags: %d\n", m.Flags)
+		fmt.Printf("Blob: %s\n", e.Fullname())
+		fmt.Printf("Size: %d\n", f.Size)
+		fmt.Printf("Mode: %s (%06o)\n", f.FileMode(), f.Mode)
+		fmt.Printf("UserID: %d\n", f.UserID)
+		fmt.Printf("GroupID: %d\n", f.GroupID)
+		fmt.Printf("InodeNumber: %d\n", f.InodeNumber)
+		fmt.Printf("ProtectionClass: %d\n", f.ProtectionClass)
+		fmt.Printf("FileFlags: %d\n", f.Flags)
+		if f.Target != "" {
+			fmt.Printf("Target: %s\n", f.Target)
+		}
+		fmt.Printf("LastModified: %s\n", f.LastModified)
+		fmt.Printf("LastStatusChange: %s\n", f.LastStatusChange)
+		fmt.Printf("Birth: %s\n", f.Birth)
+	}
+	return nil
+}
+
+func cmdCat(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("cat: path required")
+	}
+
+	for _, p := range args {
+		e, err := findPath(p)
+		if err != nil {
+			return err
+		}
+		file, ok := e.(FileEntry)
+		if !ok {
+			return fmt.Errorf("%s: is a directory", p)
+		}
+
+		fh, err := file.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(os.Stdout, fh)
+		fh.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdTree(args []string) error {
+	p := ""
+	if len(args) > 0 {
+		p = args[0]
+	}
+
+	e, err := findPath(p)
+	if err != nil {
+		return err
+	}
+
+	if global.Format != formatText {
+		rw := newRecordWriter(os.Stdout, global.Format)
+		if dir, ok := e.(*DirNode); ok {
+			for _, n := range dir.Names() {
+				if err := writeRecords(rw, path.Join(p, n), dir.entries[n], true); err != nil {
+					return err
+				}
+			}
+		} else if err := writeRecords(rw, p, e, false); err != nil {
+			return err
+		}
+		return rw.Close()
+	}
+
+	if p == "" {
+		p = "."
+	}
+	fmt.Println(p)
+
+	dirs, files := 0, 0
+	var walk func(d *DirNode, indent string)
+	walk = func(d *DirNode, indent string) {
+		names := d.Names()
+		for i, n := range names {
+			branch, next := "├── ", "│   "
+			if i == len(names)-1 {
+				branch, next = "└── ", "    "
+			}
+			fmt.Printf("%s%s%s\n", indent, branch, n)
+
+			if sub, ok := d.entries[n].(*DirNode); ok {
+				dirs++
+				walk(sub, indent+next)
+			} else {
+				files++
+			}
+		}
+	}
+
+	if dir, ok := e.(*DirNode); ok {
+		walk(dir, "")
+	} else {
+		files++
+	}
+
+	fmt.Printf("\n%d %s, %d %s\n", dirs, plural(dirs, "directory", "directories"), files, plural(files, "file", "files"))
+	return nil
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// commandUsage lists the available commands.
+func commandUsage() string {
+	var b strings.Builder
+	for _, c := range commands {
+		fmt.Fprintf(&b, "  %-5s <backup> %-12s %s\n", c.name, c.args, c.help)
+	}
+	return b.String()
+}
+
+// cmdQuery runs an SQL statement against a database from the backup, given as its domain
+// and relative path (eg: HomeDomain/Library/SMS/sms.db).  The database is opened directly
+// from the backup, read-only, so the tree is not needed.
+func cmdQuery(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("query: database path and SQL statement required")
+	}
+
+	domain, rel, ok := strings.Cut(args[0], "/")
+	if !ok || rel == "" {
+		return fmt.Errorf("%s: expected <domain>/<path>", args[0])
+	}
+	id, err := global.db.FindFile(domain, rel)
+	if err != nil {
+		return err
+	}
+	file, err := global.src.Local(blobName(id))
+	if err != nil {
+		return err
+	}
+
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.Query(args[1])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeRows(r, global.Format, os.Stdout)
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestFindFile(t *testing.T) {
+	file := testDB(t,
+		"create table files (fileID text, domain text, relativePath text, flags integer)",
+		"insert into files values ('f1', 'HomeDomain', 'Library/SMS/sms.db', 1)",
+		"insert into files values ('d1', 'HomeDomain', 'Library/SMS', 2)",
+		"insert into files values ('f2', 'MediaDomain', 'Library/SMS/sms.db', 1)",
+	)
+	conn, err := openSQLite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	db := &DB{conn}
+
+	tests := []struct {
+		domain string
+		path   string
+		want   string // id, or "" if not found
+	}{
+		{"HomeDomain", "Library/SMS/sms.db", "f1"},
+		{"MediaDomain", "Library/SMS/sms.db", "f2"},
+		{"HomeDomain", "Library/SMS", ""},
+		{"HomeDomain", "Library/SMS/missing.db", ""},
+		{"CameraRollDomain", "Library/SMS/sms.db", ""},
+	}
+	for _, tt := range tests {
+		got, err := db.FindFile(tt.domain, tt.path)
+		if (err != nil) != (tt.want == "") || got != tt.want {
+			t.Errorf("FindFile(%q, %q) = %q, %v, want %q", tt.domain, tt.path, got, err, tt.want)
+		}
+	}
+}
+
+func TestQueryArgs(t *testing.T) {
+	tests := [][]string{
+		nil,
+		{"HomeDomain/Library/SMS/sms.db"},
+		{"HomeDomain/Library/SMS/sms.db", "select 1", "extra"},
+		{"HomeDomain", "select 1"},
+		{"HomeDomain/", "select 1"},
+	}
+	for _, args := range tests {
+		if err := cmdQuery(args); err == nil {
+			t.Errorf("cmdQuery(%q) accepted", args)
+		}
+	}
+}
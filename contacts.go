@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Top level directory presenting the address book as vCards.
+const contactsDir = "Contacts"
+
+// Contact photos are kept in a separate database next to the address book.
+const addressBookImagesPath = "Library/AddressBook/AddressBookImages.sqlitedb"
+
+// More address book multi-value properties.
+const (
+	abAddress = 5
+	abURL     = 22
+)
+
+// vCard versions, selected with -vcard
+const (
+	vcard3 = "3.0"
+	vcard4 = "4.0"
+)
+
+// The file holding every contact, in addition to one per person.
+const allContacts = "All Contacts.vcf"
+
+// labelled is a phone number, email, address or URL with its label (eg: "mobile").
+type labelled struct {
+	label string
+	value string
+	parts map[string]string
+}
+
+// person is an address book entry ready for writing as a vCard.
+type person struct {
+	id                                  int64
+	first, middle, last, prefix, suffix string
+	nick, org, dept, title, note        string
+	birthday                            string
+	phones, emails, addresses, urls     []labelled
+	photo                               []byte
+}
+
+func (p *person) Name() string {
+	if name := personName(p.first, p.middle, p.last, p.org, p.nick); name != "" {
+		return name
+	}
+	return "Unnamed"
+}
+
+// addContactsView adds Contacts/ holding a vCard for each person in the address book, and
+// one with all of them.  The address book is read when the directory is first opened.
+func addContactsView(root *DirNode) error {
+	addViewDir(root, contactsDir, func(d *DirNode) error {
+		return populateContacts(root, d)
+	})
+	return nil
+}
+
+func populateContacts(root, d *DirNode) error {
+	people, err := readPeople(root)
+	if err != nil {
+		return err
+	}
+	if err := readPhotos(root, people); err != nil {
+		debug("Contact photos: %v", err)
+	}
+
+	d.entries[allContacts] = newVirtualWriter(allContacts, addressBookDomain, func(w io.Writer) error {
+		for _, p := range people {
+			if err := writeVCard(w, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	for _, p := range people {
+		p := p
+		name := uniqueName(d, safeName(p.Name())+".vcf")
+		d.entries[name] = newVirtualWriter(name, addressBookDomain, func(w io.Writer) error {
+			return writeVCard(w, p)
+		})
+	}
+	return nil
+}
+
+// abLabel converts an address book label (eg: "_$!<Mobile>!$_") to a vCard type.
+func abLabel(label string) string {
+	label = strings.TrimSuffix(strings.TrimPrefix(label, "_$!<"), ">!$_")
+	switch l := strings.ToLower(label); l {
+	case "mobile", "iphone":
+		return "cell"
+	case "homefax":
+		return "home,fax"
+	case "workfax":
+		return "work,fax"
+	case "home", "work", "main", "pager", "other":
+		return l
+	}
+	return ""
+}
+
+// readPeople reads everyone in the address book, in the order they were added.
+func readPeople(root *DirNode) ([]*person, error) {
+	file, err := backupDB(root, addressBookDomain, addressBookPath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	cols := []string{"First", "Middle", "Last", "Prefix", "Suffix", "Nickname", "Organization", "Department", "JobTitle", "Note", "Birthday"}
+	for i := range cols {
+		cols[i] = columnOr(db, "ABPerson", cols[i], "''")
+	}
+
+	r, err := db.Query("select ROWID, " + strings.Join(cols, ", ") + " from ABPerson order by ROWID")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var people []*person
+	byID := make(map[int64]*person)
+	for r.Next() {
+		p := &person{}
+		if err := r.Scan(&p.id, &p.first, &p.middle, &p.last, &p.prefix, &p.suffix, &p.nick,
+			&p.org, &p.dept, &p.title, &p.note, &p.birthday); err != nil {
+			return nil, err
+		}
+		people = append(people, p)
+		byID[p.id] = p
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	return people, readMultiValues(db, byID)
+}
+
+// readMultiValues adds the phone numbers, email addresses, addresses and URLs of each person.
+func readMultiValues(db *sql.DB, byID map[int64]*person) error {
+	// Address parts are held in separate entries keyed by name (eg: "Street")
+	parts := make(map[int64]map[string]string)
+	r, err := db.Query(`select e.parent_id, k.value, coalesce(e.value,'')
+		from ABMultiValueEntry e join ABMultiValueEntryKey k on k.ROWID = e.key`)
+	if err == nil {
+		for r.Next() {
+			var parent int64
+			var key, value string
+			if err := r.Scan(&parent, &key, &value); err != nil {
+				r.Close()
+				return err
+			}
+			if parts[parent] == nil {
+				parts[parent] = make(map[string]string)
+			}
+			parts[parent][key] = value
+		}
+		r.Close()
+	} else {
+		debug("Address book entries: %v", err)
+	}
+
+	r, err = db.Query(`select v.UID, v.record_id, v.property, coalesce(l.value,''), coalesce(v.value,'')
+		from ABMultiValue v left join ABMultiValueLabel l on l.ROWID = v.label
+		order by v.record_id, v.UID`)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var uid, record int64
+		var property int
+		var label, value string
+		if err := r.Scan(&uid, &record, &property, &label, &value); err != nil {
+			return err
+		}
+		p, ok := byID[record]
+		if !ok {
+			continue
+		}
+
+		v := labelled{label: abLabel(label), value: value}
+		switch property {
+		case abPhone:
+			p.phones = append(p.phones, v)
+		case abEmail:
+			p.emails = append(p.emails, v)
+		case abURL:
+			p.urls = append(p.urls, v)
+		case abAddress:
+			if v.parts = parts[uid]; v.parts != nil {
+				p.addresses = append(p.addresses, v)
+			}
+		}
+	}
+	return r.Err()
+}
+
+// readPhotos adds the photo of each person, using the full size image when there is one.
+func readPhotos(root *DirNode, people []*person) error {
+	file, err := backupDB(root, addressBookDomain, addressBookImagesPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	photos := make(map[int64][]byte)
+	for _, table := range []string{"ABThumbnailImage", "ABFullSizeImage"} {
+		r, err := db.Query("select record_id, data from " + table + " where data is not null")
+		if err != nil {
+			debug("Contact photos: %v", err)
+			continue
+		}
+		for r.Next() {
+			var id int64
+			var data []byte
+			if err := r.Scan(&id, &data); err != nil {
+				r.Close()
+				return err
+			}
+			photos[id] = data
+		}
+		r.Close()
+	}
+
+	for _, p := range people {
+		p.photo = photos[p.id]
+	}
+	return nil
+}
+
+// contentEscape escapes a text value in a vCard or iCalendar file.
+func contentEscape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(s)
+}
+
+// contentLine writes a vCard or iCalendar content line, folded at 75 octets without
+// splitting characters.
+func contentLine(b *strings.Builder, line string) {
+	limit := 75
+	for len(line) > limit {
+		n := limit
+		for n > 0 && !utf8.RuneStart(line[n]) {
+			n--
+		}
+		b.WriteString(line[:n] + "\r\n ")
+		line = line[n:]
+		limit = 74
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// vcardType returns the TYPE parameter for a label.
+func vcardType(label string) string {
+	if label == "" {
+		return ""
+	}
+	return ";TYPE=" + label
+}
+
+// photoType returns the image type of a contact photo, from its header.
+func photoType(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x89PNG")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "gif"
+	}
+	return "jpeg"
+}
+
+// writeVCard writes a person as a vCard of the version selected with -vcard.
+func writeVCard(w io.Writer, p *person) error {
+	var b strings.Builder
+	line := func(s string) { contentLine(&b, s) }
+
+	line("BEGIN:VCARD")
+	line("VERSION:" + global.VCard)
+	line("FN:" + contentEscape(p.Name()))
+	line("N:" + strings.Join([]string{contentEscape(p.last), contentEscape(p.first), contentEscape(p.middle),
+		contentEscape(p.prefix), contentEscape(p.suffix)}, ";"))
+	if p.nick != "" {
+		line("NICKNAME:" + contentEscape(p.nick))
+	}
+	if p.org != "" || p.dept != "" {
+		line("ORG:" + contentEscape(p.org) + ";" + contentEscape(p.dept))
+	}
+	if p.title != "" {
+		line("TITLE:" + contentEscape(p.title))
+	}
+	for _, v := range p.phones {
+		line("TEL" + vcardType(v.label) + ":" + contentEscape(v.value))
+	}
+	for _, v := range p.emails {
+		line("EMAIL" + vcardType(v.label) + ":" + contentEscape(v.value))
+	}
+	for _, v := range p.addresses {
+		adr := []string{"", ""}
+		for _, k := range []string{"Street", "City", "State", "ZIP", "Country"} {
+			adr = append(adr, contentEscape(v.parts[k]))
+		}
+		line("ADR" + vcardType(v.label) + ":" + strings.Join(adr, ";"))
+	}
+	for _, v := range p.urls {
+		line("URL" + vcardType(v.label) + ":" + v.value)
+	}
+
+	// Birthdays are stored as seconds since the Apple epoch
+	if secs, err := strconv.ParseFloat(p.birthday, 64); err == nil {
+		bday := appleTime(secs).UTC()
+		if global.VCard == vcard4 {
+			line("BDAY:" + bday.Format("20060102"))
+		} else {
+			line("BDAY:" + bday.Format("2006-01-02"))
+		}
+	}
+	if p.note != "" {
+		line("NOTE:" + contentEscape(p.note))
+	}
+
+	if p.photo != nil {
+		data := base64.StdEncoding.EncodeToString(p.photo)
+		kind := photoType(p.photo)
+		if global.VCard == vcard4 {
+			line("PHOTO:data:image/" + kind + ";base64," + data)
+		} else {
+			line(fmt.Sprintf("PHOTO;ENCODING=b;TYPE=%s:%s", strings.ToUpper(kind), data))
+		}
+	}
+	line("END:VCARD")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
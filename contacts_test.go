@@ -0,0 +1,135 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestContentEscape(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"plain", "plain"},
+		{"Smith, John", `Smith\, John`},
+		{"a;b", `a\;b`},
+		{`C:\path`, `C:\\path`},
+		{"one\ntwo\r\nthree", `one\ntwo\nthree`},
+	}
+	for _, tt := range tests {
+		if got := contentEscape(tt.s); got != tt.want {
+			t.Errorf("contentEscape(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestContentLine(t *testing.T) {
+	a75 := strings.Repeat("a", 75)
+	a74 := strings.Repeat("a", 74)
+	e := strings.Repeat("é", 40) // 80 octets
+
+	tests := []struct {
+		name string
+		line string
+		want string
+	}{
+		{"short", "FN:John", "FN:John\r\n"},
+		{"exactly 75", a75, a75 + "\r\n"},
+		{"76", a75 + "b", a75 + "\r\n b\r\n"},
+		{"continued", a75 + a74 + a74 + "b", a75 + "\r\n " + a74 + "\r\n " + a74 + "\r\n b\r\n"},
+		{"multibyte", e, strings.Repeat("é", 37) + "\r\n " + strings.Repeat("é", 3) + "\r\n"},
+		{"split character", "ab" + e, "ab" + strings.Repeat("é", 36) + "\r\n " + strings.Repeat("é", 4) + "\r\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		contentLine(&b, tt.line)
+		if b.String() != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, b.String(), tt.want)
+		}
+		for _, l := range strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n") {
+			if len(l) > 75 {
+				t.Errorf("%s: line of %d octets", tt.name, len(l))
+			}
+		}
+	}
+}
+
+func TestABLabel(t *testing.T) {
+	tests := []struct {
+		label string
+		want  string
+	}{
+		{"_$!<Mobile>!$_", "cell"},
+		{"iPhone", "cell"},
+		{"_$!<HomeFAX>!$_", "home,fax"},
+		{"_$!<WorkFAX>!$_", "work,fax"},
+		{"_$!<Home>!$_", "home"},
+		{"_$!<Other>!$_", "other"},
+		{"Cottage", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := abLabel(tt.label); got != tt.want {
+			t.Errorf("abLabel(%q) = %q, want %q", tt.label, got, tt.want)
+		}
+		if got := vcardType(tt.want); (got == "") != (tt.want == "") {
+			t.Errorf("vcardType(%q) = %q", tt.want, got)
+		}
+	}
+}
+
+func TestPhotoType(t *testing.T) {
+	tests := []struct {
+		data string
+		want string
+	}{
+		{"\x89PNG\r\n\x1a\n", "png"},
+		{"GIF89a", "gif"},
+		{"\xff\xd8\xff\xe0", "jpeg"},
+		{"", "jpeg"},
+	}
+	for _, tt := range tests {
+		if got := photoType([]byte(tt.data)); got != tt.want {
+			t.Errorf("photoType(%q) = %q, want %q", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestWriteVCard(t *testing.T) {
+	p := &person{
+		first:    "John",
+		last:     "Smith",
+		org:      "Acme, Inc.",
+		phones:   []labelled{{label: "cell", value: "+1 555 0100"}},
+		emails:   []labelled{{value: "john@example.com"}},
+		birthday: "-504921600", // 1985-01-01
+		photo:    []byte("GIF89a"),
+		addresses: []labelled{{label: "home", parts: map[string]string{
+			"Street": "1 Main St", "City": "Springfield", "ZIP": "12345"}}},
+	}
+
+	tests := []struct {
+		version string
+		want    string
+	}{
+		{vcard3, "BEGIN:VCARD\r\nVERSION:3.0\r\nFN:John Smith\r\nN:Smith;John;;;\r\nORG:Acme\\, Inc.;\r\n" +
+			"TEL;TYPE=cell:+1 555 0100\r\nEMAIL:john@example.com\r\nADR;TYPE=home:;;1 Main St;Springfield;;12345;\r\n" +
+			"BDAY:1985-01-01\r\nPHOTO;ENCODING=b;TYPE=GIF:R0lGODlh\r\nEND:VCARD\r\n"},
+		{vcard4, "BEGIN:VCARD\r\nVERSION:4.0\r\nFN:John Smith\r\nN:Smith;John;;;\r\nORG:Acme\\, Inc.;\r\n" +
+			"TEL;TYPE=cell:+1 555 0100\r\nEMAIL:john@example.com\r\nADR;TYPE=home:;;1 Main St;Springfield;;12345;\r\n" +
+			"BDAY:19850101\r\nPHOTO:data:image/gif;base64,R0lGODlh\r\nEND:VCARD\r\n"},
+	}
+
+	saved := global
+	defer func() { global = saved }()
+	for _, tt := range tests {
+		global.VCard = tt.version
+		var b strings.Builder
+		if err := writeVCard(&b, p); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.version, b.String(), tt.want)
+		}
+	}
+}
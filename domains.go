@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// The domain mounted when none are selected.
+const defaultDomain = "CameraRollDomain"
+
+// patternList is a repeatable flag holding shell style domain patterns.
+type patternList []string
+
+func (p *patternList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *patternList) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return err
+	}
+	*p = append(*p, v)
+	return nil
+}
+
+func matchAny(patterns []string, domain string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, domain); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// selectDomain reports whether files from domain are part of the tree.  Domains are chosen
+// with -A or -d (the camera roll if neither is given), less any matching an -x pattern.
+func selectDomain(domain string) bool {
+	switch {
+	case matchAny(global.Exclude, domain):
+		return false
+	case global.AllDomains:
+		return true
+	case len(global.Domains) == 0:
+		return domain == defaultDomain
+	}
+	return matchAny(global.Domains, domain)
+}
+
+// singleDomain reports whether the selection can only ever match one domain, in which case
+// its files are placed at the root of the tree rather than under a directory for the domain.
+func singleDomain() bool {
+	if global.AllDomains || len(global.Domains) > 1 {
+		return false
+	}
+	return len(global.Domains) == 0 || !strings.ContainsAny(global.Domains[0], `*?[\`)
+}
+
+// Domain layouts, selected with -layout
+const (
+	layoutGrouped = "grouped"
+	layoutFlat    = "flat"
+)
+
+// Domain is a backup domain split into its family and, for families holding one domain per
+// container, the container identifier.  eg: "AppDomain-com.vendor.game" is the "AppDomain"
+// family with id "com.vendor.game", while "HomeDomain" has no id.
+type Domain struct {
+	Name   string
+	Family string
+	ID     string
+}
+
+// domainFamilies holds the directory used for each known family in the grouped layout.
+// Families with an id use the directory as a parent, with a sub-directory for each id.
+// Unknown families use their own name, which can never clash with the names below.
+var domainFamilies = map[string]string{
+	"AppDomain":                "App Containers",
+	"AppDomainGroup":           "App Groups",
+	"AppDomainPlugin":          "App Plugins",
+	"SysContainerDomain":       "System Containers",
+	"SysSharedContainerDomain": "System Shared Containers",
+	"CameraRollDomain":         "Camera Roll",
+	"DatabaseDomain":           "Database",
+	"HealthDomain":             "Health",
+	"HomeDomain":               "Home",
+	"HomeKitDomain":            "HomeKit",
+	"InstallDomain":            "Install",
+	"KeyboardDomain":           "Keyboard",
+	"KeychainDomain":           "Keychain",
+	"ManagedPreferencesDomain": "Managed Preferences",
+	"MediaDomain":              "Media",
+	"MobileDeviceDomain":       "Mobile Device",
+	"ProtectedDomain":          "Protected",
+	"RootDomain":               "Root",
+	"SystemPreferencesDomain":  "System Preferences",
+	"TonesDomain":              "Tones",
+	"WirelessDomain":           "Wireless",
+}
+
+func parseDomain(name string) Domain {
+	family, id, _ := strings.Cut(name, "-")
+	return Domain{Name: name, Family: family, ID: id}
+}
+
+// Dirs returns the directories the domain's files are placed under when several domains
+// are mounted.
+func (d Domain) Dirs() []string {
+	if global.Layout == layoutFlat {
+		return []string{d.Name}
+	}
+
+	dir, ok := global.Families[d.Family]
+	if !ok {
+		if dir, ok = domainFamilies[d.Family]; !ok {
+			dir = d.Family
+		}
+	}
+
+	if d.ID == "" {
+		return []string{dir}
+	}
+	return []string{dir, d.ID}
+}
+
+// uniqueFamilies checks that overriding family directories has not given two families the
+// same directory, or used a directory created by a view, as their contents would be merged.
+func uniqueFamilies() bool {
+	used := make(map[string]bool)
+	for dir := range reservedNames {
+		used[dir] = true
+	}
+
+	dirs := make(map[string]string)
+	for family, dir := range domainFamilies {
+		dirs[family] = dir
+	}
+	for family, dir := range global.Families {
+		dirs[family] = dir
+	}
+	for _, dir := range dirs {
+		if used[dir] {
+			return false
+		}
+		used[dir] = true
+	}
+	return true
+}
+
+// familyMap is a repeatable flag overriding the directory used for a domain family.
+type familyMap map[string]string
+
+func (f familyMap) String() string {
+	list := make([]string, 0, len(f))
+	for k, v := range f {
+		list = append(list, k+"="+v)
+	}
+	return strings.Join(list, ",")
+}
+
+func (f familyMap) Set(v string) error {
+	family, dir, ok := strings.Cut(v, "=")
+	if !ok || family == "" || dir == "" || strings.Contains(dir, "/") {
+		return errors.New("expected <family>=<directory>")
+	}
+	f[family] = dir
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPatternList(t *testing.T) {
+	var p patternList
+	for _, v := range []string{"HomeDomain", "AppDomain-*", "*Media*"} {
+		if err := p.Set(v); err != nil {
+			t.Errorf("Set(%q): %v", v, err)
+		}
+	}
+	if err := p.Set("App["); err == nil {
+		t.Error("Set accepted a bad pattern")
+	}
+	if got, want := p.String(), "HomeDomain,AppDomain-*,*Media*"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSelectDomain(t *testing.T) {
+	tests := []struct {
+		name    string
+		all     bool
+		domains patternList
+		exclude patternList
+		match   []string
+		skip    []string
+		single  bool
+	}{
+		{
+			name:   "default",
+			match:  []string{"CameraRollDomain"},
+			skip:   []string{"HomeDomain", "MediaDomain"},
+			single: true,
+		},
+		{
+			name:   "all",
+			all:    true,
+			match:  []string{"CameraRollDomain", "HomeDomain", "AppDomain-com.vendor.App"},
+			single: false,
+		},
+		{
+			name:    "one domain",
+			domains: patternList{"HomeDomain"},
+			match:   []string{"HomeDomain"},
+			skip:    []string{"CameraRollDomain", "HomeDomainX"},
+			single:  true,
+		},
+		{
+			name:    "several domains",
+			domains: patternList{"HomeDomain", "MediaDomain"},
+			match:   []string{"HomeDomain", "MediaDomain"},
+			skip:    []string{"CameraRollDomain"},
+			single:  false,
+		},
+		{
+			name:    "wildcards",
+			domains: patternList{"AppDomain-com.whatsapp*", "*Media*"},
+			match:   []string{"AppDomain-com.whatsapp.WhatsApp", "MediaDomain", "SocialMediaDomain"},
+			skip:    []string{"AppDomain-com.vendor.App", "AppDomainGroup-group.net.whatsapp.WhatsApp.shared"},
+			single:  false,
+		},
+		{
+			name:    "exclude",
+			domains: patternList{"*Media*"},
+			exclude: patternList{"MediaDomain"},
+			match:   []string{"SocialMediaDomain"},
+			skip:    []string{"MediaDomain"},
+			single:  false,
+		},
+		{
+			name:    "exclude from all",
+			all:     true,
+			exclude: patternList{"AppDomain*", "HomeDomain"},
+			match:   []string{"CameraRollDomain", "SysContainerDomain-com.apple.x"},
+			skip:    []string{"HomeDomain", "AppDomainGroup-group.com.apple.notes"},
+			single:  false,
+		},
+	}
+
+	saved := global
+	defer func() { global = saved }()
+	for _, tt := range tests {
+		global.AllDomains = tt.all
+		global.Domains = tt.domains
+		global.Exclude = tt.exclude
+		for _, d := range tt.match {
+			if !selectDomain(d) {
+				t.Errorf("%s: %s not selected", tt.name, d)
+			}
+		}
+		for _, d := range tt.skip {
+			if selectDomain(d) {
+				t.Errorf("%s: %s selected", tt.name, d)
+			}
+		}
+		if got := singleDomain(); got != tt.single {
+			t.Errorf("%s: singleDomain() = %v, want %v", tt.name, got, tt.single)
+		}
+	}
+}
+
+func TestDomainDirs(t *testing.T) {
+	tests := []struct {
+		name     string
+		layout   string
+		families familyMap
+		family   string
+		id       string
+		dirs     []string
+	}{
+		{"HomeDomain", layoutGrouped, nil, "HomeDomain", "", []string{"Home"}},
+		{"CameraRollDomain", layoutGrouped, nil, "CameraRollDomain", "", []string{"Camera Roll"}},
+		{"AppDomain-com.vendor.App", layoutGrouped, nil, "AppDomain", "com.vendor.App", []string{"App Containers", "com.vendor.App"}},
+		{"AppDomainGroup-group.com.vendor.App-x", layoutGrouped, nil, "AppDomainGroup", "group.com.vendor.App-x", []string{"App Groups", "group.com.vendor.App-x"}},
+		{"NewDomain-x.y", layoutGrouped, nil, "NewDomain", "x.y", []string{"NewDomain", "x.y"}},
+		{"AppDomain-com.vendor.App", layoutGrouped, familyMap{"AppDomain": "Apps by id"}, "AppDomain", "com.vendor.App", []string{"Apps by id", "com.vendor.App"}},
+		{"AppDomain-com.vendor.App", layoutFlat, nil, "AppDomain", "com.vendor.App", []string{"AppDomain-com.vendor.App"}},
+		{"HomeDomain", layoutFlat, familyMap{"HomeDomain": "Home Folder"}, "HomeDomain", "", []string{"HomeDomain"}},
+	}
+
+	saved := global
+	defer func() { global = saved }()
+	for _, tt := range tests {
+		global.Layout = tt.layout
+		global.Families = tt.families
+		d := parseDomain(tt.name)
+		if d.Name != tt.name || d.Family != tt.family || d.ID != tt.id {
+			t.Errorf("parseDomain(%q) = %+v", tt.name, d)
+		}
+		if got := d.Dirs(); !reflect.DeepEqual(got, tt.dirs) {
+			t.Errorf("%s (%s): Dirs() = %q, want %q", tt.name, tt.layout, got, tt.dirs)
+		}
+	}
+}
+
+func TestFamilies(t *testing.T) {
+	tests := []struct {
+		set    []string
+		valid  bool
+		unique bool
+	}{
+		{[]string{"HomeDomain=My Home"}, true, true},
+		{[]string{"HomeDomain=My Home", "MediaDomain=My Media"}, true, true},
+		{[]string{"HomeDomain=Home"}, true, true},
+		{[]string{"NewDomain=New"}, true, true},
+		{[]string{"HomeDomain=Media"}, true, false},
+		{[]string{"HomeDomain=Both", "MediaDomain=Both"}, true, false},
+		{[]string{"HomeDomain=Media", "MediaDomain=Home"}, true, true},
+		{[]string{"HomeDomain=" + photosDir}, true, false},
+		{[]string{"HomeDomain"}, false, true},
+		{[]string{"=Home"}, false, true},
+		{[]string{"HomeDomain="}, false, true},
+		{[]string{"HomeDomain=a/b"}, false, true},
+	}
+
+	saved := global
+	defer func() { global = saved }()
+	for _, tt := range tests {
+		global.Families = make(familyMap)
+		valid := true
+		for _, v := range tt.set {
+			if err := global.Families.Set(v); err != nil {
+				valid = false
+			}
+		}
+		if valid != tt.valid {
+			t.Errorf("%q: valid = %v, want %v", tt.set, valid, tt.valid)
+		}
+		if got := uniqueFamilies(); got != tt.unique {
+			t.Errorf("%q: uniqueFamilies() = %v, want %v", tt.set, got, tt.unique)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DuRecord is the space used by a domain, or by a directory within it.
+type DuRecord struct {
+	Domain string `json:"domain"`
+	Path   string `json:"path"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func (r *DuRecord) csvHeader() []string {
+	return []string{"domain", "path", "files", "bytes"}
+}
+
+func (r *DuRecord) csvRow() []string {
+	return []string{r.Domain, r.Path, strconv.Itoa(r.Files), strconv.FormatInt(r.Bytes, 10)}
+}
+
+// duDomain holds the totals for a domain, and for each directory up to the requested depth.
+type duDomain struct {
+	DuRecord
+	dirs map[string]*DuRecord
+}
+
+// humanSize formats a size in bytes using binary units.
+func humanSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	f := float64(n)
+	i := -1
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", f, units[i])
+}
+
+// dirPrefix returns the first depth directories of the relative path p.
+func dirPrefix(p string, depth int) string {
+	dirs := strings.Split(path.Dir(p), "/")
+	if dirs[0] == "." {
+		return ""
+	}
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	return strings.Join(dirs, "/")
+}
+
+// cmdDu reports space used, using only the sizes recorded in the manifest.  Domains are
+// selected as for the tree, with the arguments adding to the -d patterns, except that all
+// domains are reported if none are given.  -depth adds the directories within each domain.
+func cmdDu(args []string) error {
+	for _, d := range args {
+		if err := global.Domains.Set(d); err != nil {
+			return err
+		}
+	}
+	if len(args) > 0 {
+		global.AllDomains = false
+	} else if len(global.Domains) == 0 {
+		global.AllDomains = true
+	}
+
+	domains := make([]*duDomain, 0, 100)
+	err := global.db.ForEachFile(func(m *ManifestFile) error {
+		if !selectDomain(m.Domain) {
+			return nil
+		}
+		if len(domains) == 0 || domains[len(domains)-1].Domain != m.Domain {
+			domains = append(domains, &duDomain{
+				DuRecord: DuRecord{Domain: m.Domain},
+				dirs:     make(map[string]*DuRecord),
+			})
+		}
+		d := domains[len(domains)-1]
+		d.Files++
+		d.Bytes += m.File.Size
+
+		if global.Depth > 0 {
+			// Count the file against each of its parent directories, up to the depth limit
+			p := dirPrefix(m.RelativePath, global.Depth)
+			for p != "" && p != "." {
+				r, ok := d.dirs[p]
+				if !ok {
+					r = &DuRecord{Domain: m.Domain, Path: p}
+					d.dirs[p] = r
+				}
+				r.Files++
+				r.Bytes += m.File.Size
+				p = path.Dir(p)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(domains, func(i, j int) bool {
+		return domains[i].Bytes > domains[j].Bytes
+	})
+
+	var rw *recordWriter
+	if global.Format != formatText {
+		rw = newRecordWriter(os.Stdout, global.Format)
+	}
+
+	var total int64
+	for _, d := range domains {
+		total += d.Bytes
+
+		dirs := make([]*DuRecord, 0, len(d.dirs))
+		for _, r := range d.dirs {
+			dirs = append(dirs, r)
+		}
+		sort.Slice(dirs, func(i, j int) bool {
+			if dirs[i].Bytes != dirs[j].Bytes {
+				return dirs[i].Bytes > dirs[j].Bytes
+			}
+			return dirs[i].Path < dirs[j].Path
+		})
+
+		if rw != nil {
+			if err := rw.Write(&d.DuRecord); err != nil {
+				return err
+			}
+			for _, r := range dirs {
+				if err := rw.Write(r); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		// Print directories beneath their parent, largest first
+		children := make(map[string][]*DuRecord)
+		for _, r := range dirs {
+			parent := path.Dir(r.Path)
+			if parent == "." {
+				parent = ""
+			}
+			children[parent] = append(children[parent], r)
+		}
+
+		var show func(parent, indent string)
+		show = func(parent, indent string) {
+			for _, r := range children[parent] {
+				fmt.Printf("%10s %8d  %s%s\n", humanSize(r.Bytes), r.Files, indent, path.Base(r.Path))
+				show(r.Path, indent+"  ")
+			}
+		}
+
+		fmt.Printf("%10s %8d  %s\n", humanSize(d.Bytes), d.Files, d.Domain)
+		show("", "  ")
+	}
+
+	if rw != nil {
+		return rw.Close()
+	}
+	fmt.Printf("%10s %8s  total\n", humanSize(total), "")
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestHumanSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{10 * 1024 * 1024, "10.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+		{5 << 50, "5.0 PiB"},
+		{1 << 62, "4.0 EiB"},
+	}
+	for _, tt := range tests {
+		if got := humanSize(tt.n); got != tt.want {
+			t.Errorf("humanSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestDirPrefix(t *testing.T) {
+	tests := []struct {
+		path  string
+		depth int
+		want  string
+	}{
+		{"file", 1, ""},
+		{"Library/file", 1, "Library"},
+		{"Library/SMS/sms.db", 1, "Library"},
+		{"Library/SMS/sms.db", 2, "Library/SMS"},
+		{"Library/SMS/sms.db", 5, "Library/SMS"},
+		{"Media/DCIM/100APPLE/IMG_0001.JPG", 2, "Media/DCIM"},
+	}
+	for _, tt := range tests {
+		if got := dirPrefix(tt.path, tt.depth); got != tt.want {
+			t.Errorf("dirPrefix(%q, %d) = %q, want %q", tt.path, tt.depth, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Extensions of the files checked for being SQLite databases.
+var sqliteExts = map[string]bool{
+	".db":        true,
+	".sqlite":    true,
+	".sqlite3":   true,
+	".sqlitedb":  true,
+	".storedata": true,
+}
+
+// addExportView adds a "<name>.d" directory next to each database, holding a CSV and JSON
+// export of each of its tables and views.  The table list is read when the directory is
+// first opened, and each export is generated when first opened.
+func addExportView(root *DirNode) error {
+	walkFiles(root, func(dir *DirNode, name string, f *FileNode) {
+		if !sqliteExts[strings.ToLower(filepath.Ext(name))] || !isSQLite(f) {
+			return
+		}
+
+		export := name + ".d"
+		if _, ok := dir.entries[export]; ok {
+			debug("Export name already in use: %s", export)
+			return
+		}
+		dir.entries[export] = newLazyDir(export, f.domain, func(d *DirNode) error {
+			return populateExport(root, d, f)
+		})
+	})
+	return nil
+}
+
+// populateExport adds the exports of each table and view of the database f to d.  Like the
+// other views, the exports include anything still in the write-ahead log.
+func populateExport(root, d *DirNode, f *FileNode) error {
+	m, err := global.db.GetFile(f.id)
+	if err != nil {
+		return err
+	}
+	file, err := backupDB(root, f.domain, m.RelativePath)
+	if err != nil {
+		return err
+	}
+
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// Virtual tables usually need modules which are not available
+	r, err := db.Query("select name from sqlite_master where type in ('table','view') and coalesce(sql,'') not like 'CREATE VIRTUAL%' order by name")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var table string
+		if err := r.Scan(&table); err != nil {
+			return err
+		}
+
+		base := safeName(table)
+		for _, format := range []string{formatCSV, formatJSON} {
+			name, format := base+"."+format, format
+			d.entries[name] = newVirtualWriter(name, d.domain, func(w io.Writer) error {
+				return exportTable(file, table, format, w)
+			})
+		}
+	}
+	return r.Err()
+}
+
+// exportValue converts a column value for output.  Blobs are base64 encoded.
+func exportValue(v any) any {
+	switch n := v.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(n)
+	case time.Time:
+		return n.Format(time.RFC3339Nano)
+	}
+	return v
+}
+
+// exportTable writes the contents of a table (or view) of the database file.
+func exportTable(file, table, format string, w io.Writer) error {
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.Query("select * from " + quoteIdent(table))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeRows(r, format, w)
+}
+
+// writeRows writes the results of a query as CSV, as a JSON array of objects, as one JSON
+// object per line or as a text table.  JSON objects keep the columns in query order.
+func writeRows(r *sql.Rows, format string, w io.Writer) error {
+	cols, err := r.Columns()
+	if err != nil {
+		return err
+	}
+
+	values := make([]any, len(cols))
+	ptrs := make([]any, len(cols))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+
+	var cw *csv.Writer
+	var tw *tabwriter.Writer
+	keys := make([]string, len(cols))
+	switch format {
+	case formatCSV:
+		cw = csv.NewWriter(w)
+		if err := cw.Write(cols); err != nil {
+			return err
+		}
+	case formatText:
+		tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(cols, "\t"))
+	case formatJSON:
+		io.WriteString(w, "[")
+		fallthrough
+	default:
+		for i, c := range cols {
+			k, _ := json.Marshal(c)
+			keys[i] = string(k)
+		}
+	}
+
+	first := true
+	row := make([]string, len(cols))
+	for r.Next() {
+		if err := r.Scan(ptrs...); err != nil {
+			return err
+		}
+
+		if cw != nil || tw != nil {
+			for i, v := range values {
+				if v == nil {
+					row[i] = ""
+				} else {
+					row[i] = fmt.Sprint(exportValue(v))
+				}
+			}
+			if tw != nil {
+				fmt.Fprintln(tw, strings.Join(row, "\t"))
+			} else if err := cw.Write(row); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Objects are written by hand to keep the columns in order
+		var b strings.Builder
+		if format == formatJSON {
+			if !first {
+				b.WriteString(",")
+			}
+			b.WriteString("\n  ")
+		}
+		first = false
+		b.WriteString("{")
+		for i, v := range values {
+			j, err := json.Marshal(exportValue(v))
+			if err != nil {
+				return err
+			}
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			b.WriteString(keys[i] + ": " + string(j))
+		}
+		b.WriteString("}")
+		if format == formatNDJSON {
+			b.WriteString("\n")
+		}
+		if _, err := io.WriteString(w, b.String()); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	switch {
+	case cw != nil:
+		cw.Flush()
+		return cw.Error()
+	case tw != nil:
+		return tw.Flush()
+	case format == formatJSON:
+		_, err = io.WriteString(w, "\n]\n")
+	}
+	return err
+}
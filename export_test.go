@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testDB creates a database in a temporary directory by running the statements, returning
+// the name of the file.
+func testDB(t *testing.T, stmts ...string) string {
+	file := filepath.Join(t.TempDir(), "test.db")
+	conn, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, s := range stmts {
+		if _, err := conn.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+	return file
+}
+
+func TestExportValue(t *testing.T) {
+	tests := []struct {
+		v    any
+		want any
+	}{
+		{nil, nil},
+		{int64(42), int64(42)},
+		{"text", "text"},
+		{[]byte{0, 1, 0xff}, "AAH/"},
+		{time.Date(2020, 9, 13, 12, 26, 40, 500, time.UTC), "2020-09-13T12:26:40.0000005Z"},
+	}
+	for _, tt := range tests {
+		if got := exportValue(tt.v); got != tt.want {
+			t.Errorf("exportValue(%v) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestExportTable(t *testing.T) {
+	file := testDB(t,
+		`create table "odd ""name""" (id integer, text text, blob blob, value real)`,
+		`insert into "odd ""name""" values (1, 'plain', x'00ff', 1.5)`,
+		`insert into "odd ""name""" values (2, 'a, "quoted"'||char(10)||'line', null, null)`,
+		`create table empty (id integer)`,
+	)
+
+	tests := []struct {
+		table  string
+		format string
+		want   string
+	}{
+		{`odd "name"`, formatCSV, `id,text,blob,value
+1,plain,AP8=,1.5
+2,"a, ""quoted""
+line",,
+`},
+		{`odd "name"`, formatJSON, `[
+  {"id": 1, "text": "plain", "blob": "AP8=", "value": 1.5},
+  {"id": 2, "text": "a, \"quoted\"\nline", "blob": null, "value": null}
+]
+`},
+		{"empty", formatCSV, "id\n"},
+		{"empty", formatJSON, "[\n]\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := exportTable(file, tt.table, tt.format, &b); err != nil {
+			t.Errorf("%s %s: %v", tt.table, tt.format, err)
+			continue
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s %s: got\n%s\nwant\n%s", tt.table, tt.format, b.String(), tt.want)
+		}
+	}
+
+	if err := exportTable(file, "missing", formatCSV, &strings.Builder{}); err == nil {
+		t.Error("exported a missing table")
+	}
+}
+
+func TestAddExportView(t *testing.T) {
+	db := testDB(t, "create table t (id integer)")
+	text := filepath.Join(t.TempDir(), "text.db")
+	if err := os.WriteFile(text, []byte("not a database at all"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files := []struct {
+		name string
+		file string
+	}{
+		{"sms.db", db},
+		{"Photos.SQLite", db},
+		{"data.bin", db},
+		{"fake.db", text},
+		{"taken.db", db},
+	}
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	for _, f := range files {
+		d.entries[f.name] = &FileNode{inode: nextID(), name: f.name, overlay: f.file}
+	}
+	d.entries["taken.db.d"] = &FileNode{inode: nextID(), name: "taken.db.d", overlay: text}
+	if err := addExportView(d); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		export bool
+	}{
+		{"sms.db.d", true},
+		{"Photos.SQLite.d", true},
+		{"data.bin.d", false},
+		{"fake.db.d", false},
+		{"taken.db.d", false},
+	}
+	for _, tt := range tests {
+		_, export := d.entries[tt.name].(*DirNode)
+		if export != tt.export {
+			t.Errorf("%s: export = %v, want %v", tt.name, export, tt.export)
+		}
+	}
+}
+
+func TestWriteRows(t *testing.T) {
+	file := testDB(t,
+		"create table t (id integer, name text)",
+		"insert into t values (1, 'one'), (22, null)",
+	)
+	db, err := openSQLite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{formatNDJSON, `{"id": 1, "name": "one"}
+{"id": 22, "name": null}
+`},
+		{formatText, `id  name
+1   one
+22  
+`},
+	}
+	for _, tt := range tests {
+		r, err := db.Query("select * from t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b strings.Builder
+		err = writeRows(r, tt.format, &b)
+		r.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.format, err)
+		} else if b.String() != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.format, b.String(), tt.want)
+		}
+	}
+}
@@ -6,6 +6,8 @@ require (
 	bazil.org/fuse v0.0.0-20230120002735-62a210ff1fd5
 	github.com/mattn/go-sqlite3 v1.14.17
 	github.com/winfsp/cgofuse v1.5.1-0.20221118130120-84c0898ad2e0
+	golang.org/x/text v0.14.0
+	howett.net/plist v1.0.0
 )
 
-require golang.org/x/sys v0.4.0 // indirect
+require golang.org/x/sys v0.5.0 // indirect
@@ -15,19 +15,52 @@ var progName = filepath.Base(os.Args[0])
 
 type Globals struct {
 	db          DB
+	src         Source
+	tmp         string
+	overlayDir  string
 	Debug       bool
 	AllDomains  bool
+	AppNames    bool
 	ListDomains bool
 	LowerCase   bool
-	Domain      string
+	MergeWAL    bool
+	ExportDB    bool
+	ConvPlist   bool
+	Messages    bool
+	Contacts    bool
+	VCard       string
+	Calendars   bool
+	Calls       bool
+	Notes       bool
+	Recordings  bool
+	Photos      bool
+	Edits       string
+	XMP         bool
+	Safari      bool
+	IgnoreCase  bool
+	DomainDirs  bool
+	Domains     patternList
+	Exclude     patternList
+	Layout      string
+	Collision   string
+	Normalize   string
+	Escape      string
+	Families    familyMap
+	Format      string
+	Depth       int
+	Overlay     string
 	Root        string
 	FSRoot      NodeEntry
 }
 
-var global Globals = Globals{}
+var global Globals = Globals{
+	Families: make(familyMap),
+}
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "%s: invalid parameters\n", progName)
+	fmt.Fprintf(os.Stderr, "usage: %s [options] <backup> <mount point>\n", progName)
+	fmt.Fprintf(os.Stderr, "       %s <command> [options] <backup> [args]\n\ncommands:\n%s", progName, commandUsage())
 }
 
 type DB struct {
@@ -36,10 +69,35 @@ type DB struct {
 
 func init() {
 	flag.BoolVar(&global.AllDomains, "A", false, "Show all backup file domains.")
+	flag.BoolVar(&global.AppNames, "apps", false, "Add an "+appsDir+" directory presenting apps by name (when mounting several domains).")
 	flag.BoolVar(&global.ListDomains, "L", false, "List all domains in backup.")
 	flag.BoolVar(&global.LowerCase, "l", false, "Convert all filenames to lowercase.")
+	flag.BoolVar(&global.IgnoreCase, "i", false, "Ignore case when looking up names, keeping the original names.")
+	flag.StringVar(&global.Overlay, "overlay", "", "Allow changes, storing changed files in a scratch directory below this one (winfsp only).")
+	flag.StringVar(&global.Normalize, "norm", normNone, "Unicode normalisation of file names: none, nfc or nfd.")
+	flag.StringVar(&global.Escape, "escape", escapeAuto, "Escape characters in file names not allowed by: none, windows or auto (windows when running on windows).")
+	flag.StringVar(&global.Collision, "collide", collideSuffix, "How to name files with duplicate names: suffix, id or fail.")
+	flag.BoolVar(&global.MergeWAL, "wal", false, "Add a snapshot of each database with a write-ahead log, with the log applied.")
+	flag.BoolVar(&global.ExportDB, "export", false, "Add a <name>.d directory next to each database, with CSV and JSON exports of each table.")
+	flag.BoolVar(&global.ConvPlist, "plist", false, "Add <name>.json and <name>.xml next to each property list, converted from binary.")
+	flag.BoolVar(&global.Messages, "messages", false, "Add a "+messagesDir+" directory with each conversation as HTML and text.")
+	flag.BoolVar(&global.Contacts, "contacts", false, "Add a "+contactsDir+" directory with a vCard for each person in the address book.")
+	flag.BoolVar(&global.Calendars, "calendars", false, "Add a "+calendarsDir+" directory with an iCalendar file for each calendar.")
+	flag.BoolVar(&global.Calls, "calls", false, "Add a \""+callsDir+"\" directory with the call log as CSV and JSON.")
+	flag.BoolVar(&global.Notes, "notes", false, "Add a "+notesDir+" directory with each note as Markdown and HTML.")
+	flag.BoolVar(&global.Recordings, "recordings", false, "Add "+voicemailDir+" and "+voiceMemosDir+" directories with recordings named by date and caller or title.")
+	flag.BoolVar(&global.Photos, "photos", false, "Add a "+photosDir+" directory presenting the camera roll by date, album and type of media.")
+	flag.StringVar(&global.Edits, "edits", editsOriginals, "Edited photos and videos in "+photosDir+": originals, latest or both.")
+	flag.BoolVar(&global.XMP, "xmp", false, "Add an XMP sidecar next to each photo and video, with its title, caption, keywords, people and location.")
+	flag.BoolVar(&global.Safari, "safari", false, "Add a "+safariDir+" directory with the browsing history as CSV, and the bookmarks and reading list as HTML.")
+	flag.StringVar(&global.VCard, "vcard", vcard3, "Version of the vCards in "+contactsDir+": 3.0 or 4.0.")
 	flag.BoolVar(&global.Debug, "v", false, "Verbose logging.")
-	flag.StringVar(&global.Domain, "d", "CameraRollDomain", "Select domain to mount.")
+	flag.Var(&global.Domains, "d", "Select domain to mount (default "+defaultDomain+"). May be repeated and may contain wildcards.")
+	flag.Var(&global.Exclude, "x", "Exclude domains matching the pattern. May be repeated.")
+	flag.StringVar(&global.Layout, "layout", layoutGrouped, "Domain directory layout: grouped (by domain family) or flat (one per domain).")
+	flag.Var(global.Families, "family", "Directory used for a domain family in the grouped layout, as <family>=<directory>. May be repeated.")
+	flag.IntVar(&global.Depth, "depth", 0, "Directory depth reported by du.")
+	flag.StringVar(&global.Format, "format", formatText, "Output format of listings: text, json, ndjson or csv.")
 }
 
 func getBackupDir() (root string) {
@@ -66,12 +124,61 @@ func getMountPoint() (mount string) {
 func openDB() error {
 	global.Root = getBackupDir()
 
-	debug("Opening database in %s", global.Root)
-	err := global.db.OpenDB(global.Root)
+	debug("Opening backup %s", global.Root)
+	src, err := OpenSource(global.Root)
+	if err != nil {
+		return err
+	}
+	global.src = src
+
+	manifest, err := src.Local("Manifest.db")
 	if err != nil {
-		log.Fatalf("%s: %v", global.Root, err)
+		return fmt.Errorf("%s: %v", global.Root, err)
+	}
+
+	debug("Opening database %s", manifest)
+	if err = global.db.OpenDB(manifest); err != nil {
+		return fmt.Errorf("%s: %v", global.Root, err)
+	}
+	return nil
+}
+
+// tempDir returns a private directory for temporary files, created on first use.
+func tempDir() (string, error) {
+	if global.tmp == "" {
+		dir, err := os.MkdirTemp("", progName+"-")
+		if err != nil {
+			return "", err
+		}
+		debug("Using temporary directory %s", dir)
+		global.tmp = dir
+	}
+	return global.tmp, nil
+}
+
+// cleanup releases the backup source and removes any temporary files.
+func cleanup() {
+	debug("Cleaning up")
+	if global.db.DB != nil {
+		global.db.Close()
+	}
+	if global.src != nil {
+		global.src.Close()
+	}
+	if global.tmp != "" {
+		os.RemoveAll(global.tmp)
 	}
-	return err
+	if global.overlayDir != "" {
+		os.RemoveAll(global.overlayDir)
+	}
+}
+
+// validOptions checks the options which take one of a fixed set of values.
+func validOptions() bool {
+	return validFormat(global.Format) && (global.Layout == layoutGrouped || global.Layout == layoutFlat) &&
+		validCollision(global.Collision) && validNames(global.Normalize, global.Escape) && uniqueFamilies() &&
+		(global.VCard == vcard3 || global.VCard == vcard4) &&
+		(global.Edits == editsOriginals || global.Edits == editsLatest || global.Edits == editsBoth)
 }
 
 func debug(fmt string, args ...any) {
@@ -86,7 +193,26 @@ func main() {
 	log.SetPrefix(progName + ": ")
 	flag.Parse()
 
-	if flag.NArg() > 2 {
+	// Commands may be followed by their own options, eg: "ls -A <backup> <path>"
+	if cmd := findCommand(flag.Arg(0)); cmd != nil {
+		flag.CommandLine.Parse(flag.Args()[1:])
+		if flag.NArg() < 1 || !validOptions() {
+			usage()
+			os.Exit(2)
+		}
+
+		err = openTree(cmd.listing)
+		if err == nil {
+			err = cmd.run(flag.Args()[1:])
+		}
+		cleanup()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if flag.NArg() > 2 || !validOptions() {
 		usage()
 		os.Exit(2)
 	}
@@ -96,17 +222,29 @@ func main() {
 
 		err = openDB()
 		if err != nil {
-			log.Fatalf("%s: %v", global.Root, err)
+			cleanup()
+			log.Fatal(err)
+		}
+
+		if global.Format != formatText {
+			err = listDomains()
+			cleanup()
+			if err != nil {
+				log.Fatal(err)
+			}
+			break
 		}
 
 		domains, err := global.db.GetDomains()
 		if err != nil {
+			cleanup()
 			log.Fatal(err)
 		}
 
 		for d := range domains {
 			fmt.Printf("%s\n", domains[d])
 		}
+		cleanup()
 
 	default:
 
@@ -118,17 +256,21 @@ func main() {
 
 		err = openDB()
 		if err != nil {
-			log.Fatalf("%s: %v", global.Root, err)
+			cleanup()
+			log.Fatal(err)
 		}
 		debug("Database opened successfully")
 
 		global.FSRoot, err = global.db.ReadListing()
 
 		if err != nil {
+			cleanup()
 			log.Fatalf("%s: %v\n", global.Root, err)
 		}
 
-		if err = mount(mountpoint); err != nil {
+		err = mount(mountpoint)
+		cleanup()
+		if err != nil {
 			log.Fatal(err)
 		}
 		debug("Completed.")
@@ -4,12 +4,13 @@ import (
 	"database/sql"
 	"fmt"
 	"io"
-	"log"
-	"path/filepath"
+	"io/fs"
+	"os"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
-	"unicode"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -28,28 +29,52 @@ func nextID() uint64 {
 }
 
 type NodeEntry interface {
-	Add(string, string, string)
+	Add(string, string, string) error
 	Find(string) NodeEntry
 	Fullname() string
 	Name() string
+	Original() string
 	ID() string
 	Domain() string
 	Dump()
 	Inode() uint64
 }
 
+// FileEntry is a NodeEntry with contents, either from the backup or generated.
+type FileEntry interface {
+	NodeEntry
+	Open() (io.ReadSeekCloser, error)
+	Stat() (fs.FileInfo, error)
+}
+
 type DirNode struct {
 	inode   uint64
 	name    string
+	orig    string
 	domain  string
 	entries map[string]NodeEntry
+	folded  map[string]string
+	target  *DirNode
+
+	// populate, when set, fills in the entries of a generated directory on first use
+	populate func(d *DirNode) error
+	loaded   *sync.Once
 }
 
 type FileNode struct {
-	inode  uint64
-	name   string
-	domain string
-	id     string
+	inode   uint64
+	name    string
+	orig    string
+	domain  string
+	id      string
+	overlay string
+
+	// links counts the directory entries referring to the file, as views present some files
+	// from the backup in more than one place
+	links int
+
+	// mtime, when set, replaces the modification time of the file (eg: with a recording date)
+	mtime time.Time
 }
 
 type FileHandle struct {
@@ -73,11 +98,59 @@ func (f *FileNode) Dump() {
 }
 
 func (f *FileNode) Fullname() string {
-	file := filepath.Join(global.Root, f.id[0:2], f.id)
+	if f.overlay != "" {
+		return f.overlay
+	}
+	file := global.src.Path(blobName(f.id))
 	debug("FileNode:Fullname Called: %s\n", file)
 	return file
 }
 
+// Open opens the blob holding the contents of the file.
+func (f *FileNode) Open() (io.ReadSeekCloser, error) {
+	debug("FileNode:Open Called")
+	if f.overlay != "" {
+		return os.Open(f.overlay)
+	}
+	return global.src.Open(blobName(f.id))
+}
+
+// Stat returns the details of the blob holding the contents of the file.
+func (f *FileNode) Stat() (fs.FileInfo, error) {
+	debug("FileNode:Stat Called")
+	if f.overlay != "" {
+		return os.Stat(f.overlay)
+	}
+	info, err := global.src.Stat(blobName(f.id))
+	if err == nil && !f.mtime.IsZero() {
+		info = timedInfo{info, f.mtime}
+	}
+	return info, err
+}
+
+// timedInfo is file information with a different modification time.  Other times are
+// dropped along with Sys(), so they are taken from the modification time too.
+type timedInfo struct {
+	fs.FileInfo
+	mtime time.Time
+}
+
+func (t timedInfo) ModTime() time.Time { return t.mtime }
+func (t timedInfo) Sys() any           { return nil }
+
+// withTime returns a copy of the file with another name and modification time, for views
+// presenting files by their metadata.
+func (f *FileNode) withTime(name string, mtime time.Time) *FileNode {
+	return &FileNode{
+		inode:  nextID(),
+		name:   name,
+		orig:   f.Original(),
+		domain: f.domain,
+		id:     f.id,
+		mtime:  mtime,
+	}
+}
+
 func (f *FileNode) Inode() uint64 {
 	debug("FileNode:Inode Called")
 	return f.inode
@@ -101,8 +174,9 @@ func (d *DirNode) Dump() {
 	}
 }
 
-func (f *FileNode) Add(id, domain, path string) {
+func (f *FileNode) Add(id, domain, path string) error {
 	debug("FileNode:Add Called")
+	return nil
 }
 
 func (f *FileNode) Find(path string) NodeEntry {
@@ -125,60 +199,32 @@ func (f *FileNode) Name() string {
 	return f.name
 }
 
-// Ugly function to convert "CameraRollDomain" into "Camera Roll", and AppDomain-com.vendor.games to "App/com.vendor.games"
-func cleanDomain(d string) []string {
-
-	w := false
-	s := ""
-	p := []string{}
-
-	for _, l := range d {
-		switch {
-		case l == '-':
-			if s != "" {
-
-				if strings.HasSuffix(s, " Domain") {
-					s = s[0 : len(s)-7]
-				}
-
-				p = append(p, s)
-				s = ""
-				w = false
-			}
-
-		default:
-			if unicode.IsUpper(l) {
-				if w {
-					s = s + " "
-				}
-				w = false
-			} else if unicode.IsLower(l) {
-				w = true
-			}
-			s = s + string(l)
-		}
-	}
-	if s != "" {
-
-		if strings.HasSuffix(s, " Domain") {
-			s = s[0 : len(s)-7]
-		}
-
-		p = append(p, s)
+// Original returns the name as found in the backup, before any mapping by mapName().
+func (f *FileNode) Original() string {
+	debug("FileNode:Original Called")
+	if f.orig == "" {
+		return f.name
 	}
-	debug("Cleaned %s: %#v", d, p)
-	return p
+	return f.orig
 }
 
-func (d *DirNode) Add(id, domain, path string) {
+func (d *DirNode) Add(id, domain, path string) error {
 	debug("DirNode:Add Called: %s %-32s %s", id, domain, path)
 	p := strings.Split(path, "/")
 	fp := d
 
-	// Handle "AllDomains" option by pre-pending domain name (after cleaning)
-	if global.AllDomains {
-		d := cleanDomain(domain)
+	// Names from the backup are mapped, while the domain directories are used as is
+	orig := p
+	p = make([]string, len(orig))
+	for i := range orig {
+		p[i] = mapName(orig[i])
+	}
+
+	// Handle multiple domains by pre-pending the directories for the domain
+	if global.DomainDirs {
+		d := parseDomain(domain).Dirs()
 		p = append(d, p...)
+		orig = append(d, orig...)
 	}
 
 	lp := len(p) - 1
@@ -186,48 +232,51 @@ func (d *DirNode) Add(id, domain, path string) {
 	for i := range p {
 		if i == lp {
 			name := p[i]
-			if global.LowerCase {
-				name = strings.ToLower(name)
-			}
-			name_base := filepath.Base(name)
-			name_ext := filepath.Ext(name)
-			name_idx := 1
+
 			// Scan to resolve duplicates
-			for {
-				if _, ok := fp.entries[name]; ok {
-					name = fmt.Sprintf("%s (%d).%s", name_base, name_idx, name_ext)
-					name_idx++
-				} else {
+			unique := name
+			for n := 1; ; n++ {
+				if _, ok := fp.entries[unique]; !ok {
 					break
 				}
+				if global.Collision == collideFail {
+					return fmt.Errorf("duplicate file name: %s (%s %s)", name, domain, path)
+				}
+				unique = altName(name, id, n)
 			}
+			debug("DirNode:Add using name %s", unique)
 
-			fp.entries[name] = &FileNode{
+			fp.entries[unique] = &FileNode{
 				inode:  nextID(),
-				name:   name,
+				name:   unique,
+				orig:   orig[i],
 				domain: domain,
 				id:     id,
+				links:  1,
 			}
 		} else {
-			fn, ok := fp.entries[p[i]]
-			if ok {
-				var ok bool
-				// This error suggests a problem with "cleanDomain()" above resulting in duplicates
-				if fp, ok = fn.(*DirNode); !ok {
-					log.Fatalf("Found existing file where directory expected: %s", fn.(*FileNode).Fullname())
+			// A file may already be using the directory name (eg: after lowercasing), so
+			// follow the same alternative names until a directory or a free slot is found
+			name := p[i]
+			for n := 1; ; n++ {
+				fn, ok := fp.entries[name]
+				if !ok {
+					fp = fp.Subdir(name, domain)
+					fp.orig = orig[i]
+					break
+				}
+				if dir, ok := fn.(*DirNode); ok {
+					fp = dir
+					break
 				}
-			} else {
-				fp.entries[p[i]] = &DirNode{
-					inode:   nextID(),
-					name:    p[i],
-					domain:  domain,
-					entries: make(map[string]NodeEntry),
+				if global.Collision == collideFail {
+					return fmt.Errorf("found existing file where directory expected: %s", fn.(*FileNode).Fullname())
 				}
-				fp = fp.entries[p[i]].(*DirNode)
+				name = altName(p[i], "", n)
 			}
 		}
 	}
-	return
+	return nil
 }
 
 func (d *DirNode) Domain() string {
@@ -240,6 +289,15 @@ func (d *DirNode) Name() string {
 	return d.name
 }
 
+// Original returns the name as found in the backup, before any mapping by mapName().
+func (d *DirNode) Original() string {
+	debug("DirNode:Original Called")
+	if d.orig == "" {
+		return d.name
+	}
+	return d.orig
+}
+
 func (d *DirNode) ID() string {
 	debug("DirNode:ID Called")
 	return ""
@@ -250,6 +308,167 @@ func (d *DirNode) Find(path string) NodeEntry {
 	return nil
 }
 
+// Subdir returns the named sub-directory, creating it if needed.  Returns nil if a file
+// already exists with that name.
+func (d *DirNode) Subdir(name, domain string) *DirNode {
+	if e, ok := d.entries[name]; ok {
+		sub, _ := e.(*DirNode)
+		return sub
+	}
+	sub := &DirNode{
+		inode:   nextID(),
+		name:    name,
+		domain:  domain,
+		entries: make(map[string]NodeEntry),
+	}
+	d.entries[name] = sub
+	return sub
+}
+
+// newLazyDir creates a directory whose entries are generated by populate when first needed.
+// If populate fails, the directory holds an ERROR.txt describing the problem instead.
+func newLazyDir(name, domain string, populate func(d *DirNode) error) *DirNode {
+	return &DirNode{
+		inode:    nextID(),
+		name:     name,
+		domain:   domain,
+		entries:  make(map[string]NodeEntry),
+		populate: populate,
+		loaded:   new(sync.Once),
+	}
+}
+
+func (d *DirNode) load() {
+	if d.populate == nil {
+		return
+	}
+	d.loaded.Do(func() {
+		debug("DirNode:load Called: %s", d.name)
+		if err := d.populate(d); err != nil {
+			debug("DirNode:load failed: %v", err)
+			msg := fmt.Sprintf("%s: %v\n", d.name, err)
+			d.entries["ERROR.txt"] = newVirtualWriter("ERROR.txt", d.domain, func(w io.Writer) error {
+				_, err := io.WriteString(w, msg)
+				return err
+			})
+		}
+		if global.IgnoreCase {
+			d.foldNames()
+		}
+	})
+}
+
+// Entries returns the directory entries, generating them first if needed.
+func (d *DirNode) Entries() map[string]NodeEntry {
+	d.load()
+	return d.entries
+}
+
+// Alias returns a new directory sharing the entries of d, for presenting the same content
+// in more than one place.
+func (d *DirNode) Alias(name string) *DirNode {
+	return &DirNode{
+		inode:   nextID(),
+		name:    name,
+		domain:  d.domain,
+		entries: d.entries,
+		target:  d.base(),
+	}
+}
+
+// base returns the directory holding the entries, which for an alias is the original.  It
+// also holds the case-insensitive index, so changes made through either are seen by both.
+func (d *DirNode) base() *DirNode {
+	if d.target != nil {
+		return d.target
+	}
+	return d
+}
+
+// Names returns the names of the directory entries, sorted.
+func (d *DirNode) Names() []string {
+	d.load()
+	return d.sortedNames()
+}
+
+func (d *DirNode) sortedNames() []string {
+	names := make([]string, 0, len(d.entries))
+	for n := range d.entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the named entry, or nil if it does not exist.  With -i, a name not found
+// exactly is matched ignoring case.  If several entries differ only by case, the first in
+// sorted order is returned, so the result is always the same.
+func (d *DirNode) Lookup(name string) NodeEntry {
+	_, e := d.find(name)
+	return e
+}
+
+// find returns the named entry as Lookup does, along with the name it is held under.
+func (d *DirNode) find(name string) (string, NodeEntry) {
+	d.load()
+	if e, ok := d.entries[name]; ok {
+		return name, e
+	}
+	if folded := d.base().folded; folded != nil {
+		if n, ok := folded[strings.ToLower(name)]; ok {
+			if e, ok := d.entries[n]; ok {
+				return n, e
+			}
+		}
+	}
+	return "", nil
+}
+
+// foldNames builds the case-insensitive index used by Lookup, for d and everything below it.
+// Generated directories build their own index once populated.
+func (d *DirNode) foldNames() {
+	if d.target != nil {
+		if d.target.folded == nil {
+			d.target.foldNames()
+		}
+		return
+	}
+	d.refold()
+	for _, e := range d.entries {
+		if sub, ok := e.(*DirNode); ok && sub.populate == nil {
+			sub.foldNames()
+		}
+	}
+}
+
+// refold rebuilds the case-insensitive index of d only.
+func (d *DirNode) refold() {
+	d.folded = make(map[string]string, len(d.entries))
+	for _, n := range d.sortedNames() {
+		f := strings.ToLower(n)
+		if _, ok := d.folded[f]; !ok {
+			d.folded[f] = n
+		}
+	}
+}
+
+// lookupPath walks the tree below e following the slash separated path, returning nil
+// if it does not exist.
+func lookupPath(e NodeEntry, path string) NodeEntry {
+	for _, c := range strings.Split(path, "/") {
+		if c != "" {
+			dir, ok := e.(*DirNode)
+			if !ok {
+				return nil
+			}
+			if e = dir.Lookup(c); e == nil {
+				return nil
+			}
+		}
+	}
+	return e
+}
+
 func (d *DB) GetDomains() ([]string, error) {
 	debug("DB:GetDomains Called")
 	r, err := d.Query("select distinct domain from files where flags=1")
@@ -280,21 +499,32 @@ func (d *DB) ReadListing() (NodeEntry, error) {
 		entries: make(map[string]NodeEntry),
 		inode:   nextID(),
 	}
+	global.DomainDirs = !singleDomain()
 
 	for r.Next() {
 		var id, path, domain string
 		r.Scan(&id, &path, &domain)
-		if global.AllDomains || domain == global.Domain {
-			dirs.Add(id, domain, path)
+		if selectDomain(domain) {
+			if err := dirs.Add(id, domain, path); err != nil {
+				return nil, err
+			}
 		}
 	}
 
+	if err = addViews(dirs.(*DirNode)); err != nil {
+		return nil, err
+	}
+
+	if global.IgnoreCase {
+		dirs.(*DirNode).foldNames()
+	}
 	return dirs, nil
 }
 
+// OpenDB opens the manifest database, file being the local copy of Manifest.db.
 func (d *DB) OpenDB(file string) (err error) {
 	debug("DB:OpenDB Called")
-	d.DB, err = sql.Open("sqlite3", fmt.Sprintf("file:%s/Manifest.db?immutable=1&mode=ro", file))
+	d.DB, err = openSQLite(file)
 
 	if err != nil {
 		panic(err)
@@ -302,3 +532,179 @@ func (d *DB) OpenDB(file string) (err error) {
 
 	return err
 }
+
+// MBFile holds the metadata the backup keeps for each file, stored in the "file" column of
+// the manifest as an archived MBFile object.
+type MBFile struct {
+	RelativePath     string
+	Target           string
+	Size             int64
+	Mode             uint32
+	UserID           int64
+	GroupID          int64
+	InodeNumber      int64
+	ProtectionClass  int64
+	Flags            int64
+	LastModified     time.Time
+	LastStatusChange time.Time
+	Birth            time.Time
+}
+
+// ManifestFile is a single row of the manifest.
+type ManifestFile struct {
+	ID           string
+	Domain       string
+	RelativePath string
+	Flags        int
+	File         *MBFile
+}
+
+func decodeMBFile(data []byte) (*MBFile, error) {
+	v, err := unarchive(data)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected MBFile contents: %T", v)
+	}
+
+	f := &MBFile{
+		Size:             toInt64(m["Size"]),
+		Mode:             uint32(toInt64(m["Mode"])),
+		UserID:           toInt64(m["UserID"]),
+		GroupID:          toInt64(m["GroupID"]),
+		InodeNumber:      toInt64(m["InodeNumber"]),
+		ProtectionClass:  toInt64(m["ProtectionClass"]),
+		Flags:            toInt64(m["Flags"]),
+		LastModified:     time.Unix(toInt64(m["LastModified"]), 0),
+		LastStatusChange: time.Unix(toInt64(m["LastStatusChange"]), 0),
+		Birth:            time.Unix(toInt64(m["Birth"]), 0),
+	}
+	f.RelativePath, _ = m["RelativePath"].(string)
+	f.Target, _ = m["Target"].(string)
+	return f, nil
+}
+
+// FileMode converts the unix mode of the file to an fs.FileMode.
+func (f *MBFile) FileMode() fs.FileMode {
+	mode := fs.FileMode(f.Mode & 0777)
+	switch f.Mode & 0170000 {
+	case 0040000:
+		mode |= fs.ModeDir
+	case 0120000:
+		mode |= fs.ModeSymlink
+	}
+	return mode
+}
+
+// GetFile returns the manifest entry for file id.
+func (d *DB) GetFile(id string) (*ManifestFile, error) {
+	debug("DB:GetFile Called: %s", id)
+	var blob []byte
+	m := &ManifestFile{ID: id}
+
+	err := d.QueryRow("select domain,relativepath,flags,file from files where fileid=?", id).Scan(&m.Domain, &m.RelativePath, &m.Flags, &blob)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.File, err = decodeMBFile(blob); err != nil {
+		return nil, fmt.Errorf("%s: %w", id, err)
+	}
+	return m, nil
+}
+
+// FindFile returns the file id of the file at path within domain.
+func (d *DB) FindFile(domain, path string) (string, error) {
+	debug("DB:FindFile Called: %s %s", domain, path)
+	var id string
+	err := d.QueryRow("select fileid from files where domain=? and relativepath=? and flags=1", domain, path).Scan(&id)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf("%s/%s: no such file in the backup", domain, path)
+	}
+	return id, err
+}
+
+// FindFiles returns the relative paths of the files within domain matching the SQL LIKE
+// pattern, sorted.
+func (d *DB) FindFiles(domain, pattern string) ([]string, error) {
+	debug("DB:FindFiles Called: %s %s", domain, pattern)
+	r, err := d.Query("select relativepath from files where domain=? and relativepath like ? and flags=1 order by relativepath", domain, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var list []string
+	for r.Next() {
+		var path string
+		if err := r.Scan(&path); err != nil {
+			return nil, err
+		}
+		list = append(list, path)
+	}
+	return list, r.Err()
+}
+
+// FileIDs returns the IDs of the files within domain matching the SQL LIKE pattern, keyed
+// by relative path.
+func (d *DB) FileIDs(domain, pattern string) (map[string]string, error) {
+	debug("DB:FileIDs Called: %s %s", domain, pattern)
+	r, err := d.Query("select fileid, relativepath from files where domain=? and relativepath like ? and flags=1", domain, pattern)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ids := make(map[string]string)
+	for r.Next() {
+		var id, path string
+		if err := r.Scan(&id, &path); err != nil {
+			return nil, err
+		}
+		ids[path] = id
+	}
+	return ids, r.Err()
+}
+
+// ForEachFile calls fn for every file in the manifest, in domain order.
+func (d *DB) ForEachFile(fn func(*ManifestFile) error) error {
+	debug("DB:ForEachFile Called")
+	r, err := d.Query("select fileid,domain,relativepath,flags,file from files where flags=1 order by domain")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var blob []byte
+		m := &ManifestFile{}
+		if err = r.Scan(&m.ID, &m.Domain, &m.RelativePath, &m.Flags, &blob); err != nil {
+			return err
+		}
+		if m.File, err = decodeMBFile(blob); err != nil {
+			return fmt.Errorf("%s: %w", m.ID, err)
+		}
+		if err = fn(m); err != nil {
+			return err
+		}
+	}
+	return r.Err()
+}
+
+// GetDomainStats returns the number of files and total size of each domain.
+func (d *DB) GetDomainStats() ([]*DomainRecord, error) {
+	debug("DB:GetDomainStats Called")
+	list := make([]*DomainRecord, 0, 100)
+
+	err := d.ForEachFile(func(m *ManifestFile) error {
+		if len(list) == 0 || list[len(list)-1].Domain != m.Domain {
+			list = append(list, &DomainRecord{Domain: m.Domain})
+		}
+		list[len(list)-1].Files++
+		list[len(list)-1].Bytes += m.File.Size
+		return nil
+	})
+	return list, err
+}
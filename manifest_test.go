@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+)
+
+func TestDecodeMBFile(t *testing.T) {
+	data := archive(t, plist.UID(1),
+		map[string]any{
+			"$class":           plist.UID(3),
+			"RelativePath":     plist.UID(2),
+			"Size":             uint64(1234),
+			"Mode":             uint64(0100644),
+			"UserID":           uint64(501),
+			"GroupID":          uint64(501),
+			"InodeNumber":      uint64(98765),
+			"ProtectionClass":  uint64(3),
+			"Flags":            uint64(0),
+			"LastModified":     uint64(1600000000),
+			"LastStatusChange": uint64(1600000001),
+			"Birth":            uint64(1500000000),
+			"Target":           plist.UID(0),
+		},
+		"Media/DCIM/100APPLE/IMG_0001.JPG",
+		class("MBFile"),
+	)
+
+	got, err := decodeMBFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &MBFile{
+		RelativePath:     "Media/DCIM/100APPLE/IMG_0001.JPG",
+		Size:             1234,
+		Mode:             0100644,
+		UserID:           501,
+		GroupID:          501,
+		InodeNumber:      98765,
+		ProtectionClass:  3,
+		LastModified:     time.Unix(1600000000, 0),
+		LastStatusChange: time.Unix(1600000001, 0),
+		Birth:            time.Unix(1500000000, 0),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := decodeMBFile(archive(t, plist.UID(1), "not a file")); err == nil {
+		t.Error("got no error for an archive which is not an MBFile")
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	tests := []struct {
+		mode uint32
+		want fs.FileMode
+	}{
+		{0100644, 0644},
+		{0100755, 0755},
+		{0040755, fs.ModeDir | 0755},
+		{0120777, fs.ModeSymlink | 0777},
+		{0104755, 0755},
+	}
+	for _, tt := range tests {
+		f := &MBFile{Mode: tt.mode}
+		if got := f.FileMode(); got != tt.want {
+			t.Errorf("FileMode(%06o) = %v, want %v", tt.mode, got, tt.want)
+		}
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+	global.DomainDirs = false
+
+	root := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	for _, p := range []string{"Media/DCIM/100APPLE/IMG_0001.JPG", "Media/DCIM/100APPLE/IMG_0002.JPG", "Library/a.db"} {
+		if err := root.Add(p, "CameraRollDomain", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		path string
+		want string // id of the file, "/" for a directory or "" if not found
+	}{
+		{"", "/"},
+		{"/", "/"},
+		{"Media", "/"},
+		{"Media/DCIM/", "/"},
+		{"Media/DCIM/100APPLE/IMG_0001.JPG", "Media/DCIM/100APPLE/IMG_0001.JPG"},
+		{"/Media//DCIM/100APPLE/IMG_0002.JPG", "Media/DCIM/100APPLE/IMG_0002.JPG"},
+		{"Library/a.db", "Library/a.db"},
+		{"Library/a.db/b", ""},
+		{"Media/dcim", ""},
+		{"Missing", ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		switch e := lookupPath(root, tt.path).(type) {
+		case *DirNode:
+			got = "/"
+		case *FileNode:
+			got = e.id
+		}
+		if got != tt.want {
+			t.Errorf("lookupPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLookupIgnoreCase(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+	global.DomainDirs = false
+
+	root := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	for _, p := range []string{"Media/DCIM/IMG_0001.JPG", "Media/DCIM/img_0001.jpg", "Media/Readme.txt", "Library/a.db"} {
+		if err := root.Add(p, "CameraRollDomain", p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	media := root.Lookup("Media").(*DirNode)
+	root.Insert("Alias", media.Alias("Alias"))
+	root.Insert("Lazy", newLazyDir("Lazy", "", func(d *DirNode) error {
+		d.Insert("Generated.TXT", newVirtualWriter("Generated.TXT", "", nil))
+		return nil
+	}))
+
+	tests := []struct {
+		path  string
+		exact string // name found without -i, "" if not found
+		fold  string // name found with -i, "" if not found
+	}{
+		{"Media/Readme.txt", "Readme.txt", "Readme.txt"},
+		{"media/readme.TXT", "", "Readme.txt"},
+		{"MEDIA/dcim/IMG_0001.JPG", "", "IMG_0001.JPG"},
+		{"Media/DCIM/img_0001.jpg", "img_0001.jpg", "img_0001.jpg"},
+		{"Media/DCIM/Img_0001.Jpg", "", "IMG_0001.JPG"},
+		{"alias/README.TXT", "", "Readme.txt"},
+		{"Alias/dcim", "", "DCIM"},
+		{"lazy/generated.txt", "", "Generated.TXT"},
+		{"Library/A.db/b", "", ""},
+		{"Missing", "", ""},
+	}
+	for _, fold := range []bool{false, true} {
+		global.IgnoreCase = fold
+		if fold {
+			root.foldNames()
+		}
+		for _, tt := range tests {
+			want := tt.exact
+			if fold {
+				want = tt.fold
+			}
+			got := ""
+			if e := lookupPath(root, tt.path); e != nil {
+				got = e.Name()
+			}
+			if got != want {
+				t.Errorf("-i=%v: lookupPath(%q) = %q, want %q", fold, tt.path, got, want)
+			}
+		}
+	}
+}
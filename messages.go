@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Top level directory presenting the conversations in the messages database.
+const messagesDir = "Messages"
+
+// Location of the messages database in the backup.  Attachments are in the media domain.
+const (
+	smsDomain   = "HomeDomain"
+	smsPath     = "Library/SMS/sms.db"
+	mediaDomain = "MediaDomain"
+)
+
+// Tapback reactions, stored as messages with an associated_message_type of 2000 and up.
+// Removing a reaction uses the same kind plus 1000.
+var tapbacks = []string{"Loved", "Liked", "Disliked", "Laughed at", "Emphasized", "Questioned"}
+
+// Image types shown inline in the HTML rendering of a conversation.
+var inlineImages = map[string]bool{
+	".gif":  true,
+	".jpeg": true,
+	".jpg":  true,
+	".png":  true,
+	".webp": true,
+}
+
+// conversation collects the chats with the same contacts (such as the iMessage and SMS
+// chats with one person) into one directory.
+type conversation struct {
+	title       string
+	chats       []int64
+	dir         *DirNode
+	attachments map[int64]string
+}
+
+// message is a message ready for rendering.
+type message struct {
+	guid        string
+	date        time.Time
+	sender      string
+	fromMe      bool
+	service     string
+	text        string
+	attachments []string
+	reactions   []string
+}
+
+// messageTime converts a message date, which is in seconds since the Apple epoch before iOS
+// 11 and nanoseconds since.
+func messageTime(v int64) time.Time {
+	if v > 1e11 {
+		return appleEpoch.Add(time.Duration(v))
+	}
+	return appleTime(float64(v))
+}
+
+// attributedText extracts the string from an NSAttributedString in typedstream format, as
+// stored in attributedBody when text is not set (from iOS 16).
+func attributedText(data []byte) string {
+	i := bytes.Index(data, []byte("NSString"))
+	if i < 0 {
+		return ""
+	}
+	data = data[i:]
+	if i = bytes.IndexByte(data, '+'); i < 0 || i+2 > len(data) {
+		return ""
+	}
+	data = data[i+1:]
+
+	n, data := int(data[0]), data[1:]
+	switch {
+	case n == 0x81 && len(data) >= 2:
+		n, data = int(data[0])|int(data[1])<<8, data[2:]
+	case n == 0x82 && len(data) >= 4:
+		n, data = int(data[0])|int(data[1])<<8|int(data[2])<<16|int(data[3])<<24, data[4:]
+	}
+	if n > len(data) {
+		return ""
+	}
+	return string(data[:n])
+}
+
+// addMessagesView adds Messages/<Contact>/ with each conversation rendered as HTML and plain
+// text, along with its attachments.  The messages database is read when first opened.
+func addMessagesView(root *DirNode) error {
+	addViewDir(root, messagesDir, func(d *DirNode) error {
+		return populateMessages(root, d)
+	})
+	return nil
+}
+
+func populateMessages(root, d *DirNode) error {
+	file, err := backupDB(root, smsDomain, smsPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	handles, err := readHandles(root, db)
+	if err != nil {
+		return err
+	}
+
+	// The names of the people in each chat, and their phone numbers or emails
+	members := make(map[int64][]string)
+	people := make(map[int64][]string)
+	r, err := db.Query(`select j.chat_id, j.handle_id, coalesce(h.id,'')
+		from chat_handle_join j join handle h on h.ROWID = j.handle_id`)
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		var chat, handle int64
+		var person string
+		if err := r.Scan(&chat, &handle, &person); err != nil {
+			r.Close()
+			return err
+		}
+		if name, ok := handles[handle]; ok {
+			members[chat] = append(members[chat], name)
+			people[chat] = append(people[chat], person)
+		}
+	}
+	r.Close()
+
+	// Chats are grouped by their name and the people in them, so that the iMessage and SMS
+	// chats with someone are together, while different people with the same name are not
+	convs := make(map[string]*conversation)
+	byChat := make(map[int64]*conversation)
+	r, err = db.Query("select ROWID, coalesce(display_name,''), coalesce(chat_identifier,'') from chat order by ROWID")
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		var id int64
+		var title, ident string
+		if err := r.Scan(&id, &title, &ident); err != nil {
+			r.Close()
+			return err
+		}
+		sort.Strings(people[id])
+		key := title + "\x00" + strings.Join(people[id], "\x00")
+		if len(people[id]) == 0 {
+			key += ident
+		}
+
+		if title == "" {
+			sort.Strings(members[id])
+			title = strings.Join(members[id], ", ")
+		}
+		if title == "" {
+			title = contactName(root, ident)
+		}
+
+		c, ok := convs[key]
+		if !ok {
+			c = &conversation{title: title, attachments: make(map[int64]string)}
+			name := uniqueName(d, safeName(title))
+			c.dir = d.Subdir(name, smsDomain)
+			convs[key] = c
+		}
+		c.chats = append(c.chats, id)
+		byChat[id] = c
+	}
+	r.Close()
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	if err := addAttachments(root, db, byChat); err != nil {
+		return err
+	}
+
+	for _, c := range convs {
+		c := c
+		for _, format := range []string{"html", "txt"} {
+			name, format := "messages."+format, format
+			c.dir.entries[name] = newVirtualWriter(name, smsDomain, func(w io.Writer) error {
+				msgs, err := readConversation(file, handles, c)
+				if err != nil {
+					return err
+				}
+				if format == "html" {
+					return writeConversationHTML(w, c, msgs)
+				}
+				return writeConversationText(w, c, msgs)
+			})
+		}
+	}
+	return nil
+}
+
+// readHandles returns the contact name (or phone number or email) of each handle.
+func readHandles(root *DirNode, db *sql.DB) (map[int64]string, error) {
+	handles := make(map[int64]string)
+	r, err := db.Query("select ROWID, id from handle")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var id int64
+		var handle string
+		if err := r.Scan(&id, &handle); err != nil {
+			return nil, err
+		}
+		handles[id] = contactName(root, handle)
+	}
+	return handles, r.Err()
+}
+
+// addAttachments adds the attachments of each conversation to its Attachments directory,
+// sharing the files from the media domain.  Attachments missing from the backup (such as
+// those only kept in iCloud) are skipped.
+func addAttachments(root *DirNode, db *sql.DB, byChat map[int64]*conversation) error {
+	r, err := db.Query(`select distinct cmj.chat_id, a.ROWID, coalesce(a.filename,''), coalesce(a.transfer_name,'')
+		from attachment a
+		join message_attachment_join maj on maj.attachment_id = a.ROWID
+		join chat_message_join cmj on cmj.message_id = maj.message_id
+		order by a.ROWID`)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var chat, id int64
+		var filename, transfer string
+		if err := r.Scan(&chat, &id, &filename, &transfer); err != nil {
+			return err
+		}
+		c, ok := byChat[chat]
+		if !ok || filename == "" {
+			continue
+		}
+		if _, ok := c.attachments[id]; ok {
+			continue
+		}
+
+		path := strings.TrimPrefix(strings.TrimPrefix(filename, "~/"), "/var/mobile/")
+		f, err := backupFile(root, mediaDomain, path)
+		if err != nil {
+			debug("Attachment %s: %v", filename, err)
+			continue
+		}
+
+		if transfer == "" {
+			transfer = filepath.Base(path)
+		}
+		dir := c.dir.Subdir("Attachments", mediaDomain)
+		name := uniqueName(dir, safeName(transfer))
+		dir.entries[name] = f
+		f.links++
+		c.attachments[id] = name
+	}
+	return r.Err()
+}
+
+// readConversation reads the messages of a conversation in date order, with reactions
+// attached to the message they refer to.
+func readConversation(file string, handles map[int64]string, c *conversation) ([]*message, error) {
+	db, err := openSQLite(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ids := make([]string, len(c.chats))
+	for i, id := range c.chats {
+		ids[i] = fmt.Sprint(id)
+	}
+	chats := strings.Join(ids, ",")
+
+	attachments := make(map[int64][]string)
+	r, err := db.Query(`select maj.message_id, maj.attachment_id from message_attachment_join maj
+		join chat_message_join cmj on cmj.message_id = maj.message_id
+		where cmj.chat_id in (` + chats + `) order by maj.ROWID`)
+	if err != nil {
+		return nil, err
+	}
+	for r.Next() {
+		var msg, att int64
+		if err := r.Scan(&msg, &att); err != nil {
+			r.Close()
+			return nil, err
+		}
+		if name, ok := c.attachments[att]; ok {
+			attachments[msg] = append(attachments[msg], name)
+		}
+	}
+	r.Close()
+
+	r, err = db.Query(`select distinct m.ROWID, coalesce(m.guid,''), coalesce(m.text,''), ` + columnOr(db, "message", "attributedBody", "null") + `,
+		coalesce(m.handle_id,0), coalesce(m.is_from_me,0), coalesce(m.date,0), coalesce(m.service,''),
+		` + columnOr(db, "message", "associated_message_guid", "''") + `, ` + columnOr(db, "message", "associated_message_type", "0") + `
+		from message m join chat_message_join cmj on cmj.message_id = m.ROWID
+		where cmj.chat_id in (` + chats + `) order by m.date, m.ROWID`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var msgs []*message
+	byGUID := make(map[string]*message)
+	type reaction struct {
+		target, sender string
+		kind           int
+	}
+	var reactions []reaction
+
+	for r.Next() {
+		var id, handle, date int64
+		var fromMe bool
+		var body []byte
+		var assocType int
+		var assoc string
+		m := &message{}
+		if err := r.Scan(&id, &m.guid, &m.text, &body, &handle, &fromMe, &date, &m.service, &assoc, &assocType); err != nil {
+			return nil, err
+		}
+
+		m.fromMe = fromMe
+		m.date = messageTime(date)
+		switch {
+		case fromMe:
+			m.sender = "Me"
+		case handles[handle] != "":
+			m.sender = handles[handle]
+		default:
+			m.sender = "Unknown"
+		}
+
+		if assocType >= 2000 && assocType < 4000 {
+			// eg: "p:0/<guid>" for a part of a message, or "bp:<guid>"
+			target := assoc[strings.LastIndexAny(assoc, ":/")+1:]
+			reactions = append(reactions, reaction{target, m.sender, assocType})
+			continue
+		}
+
+		if m.text == "" && body != nil {
+			m.text = attributedText(body)
+		}
+		m.text = strings.TrimSpace(strings.ReplaceAll(m.text, "\uFFFC", ""))
+		m.attachments = attachments[id]
+		msgs = append(msgs, m)
+		byGUID[m.guid] = m
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, rc := range reactions {
+		m, ok := byGUID[rc.target]
+		kind := rc.kind % 1000
+		if !ok || kind >= len(tapbacks) {
+			continue
+		}
+		text := tapbacks[kind] + " by " + rc.sender
+		if rc.kind >= 3000 {
+			for i := range m.reactions {
+				if m.reactions[i] == text {
+					m.reactions = append(m.reactions[:i], m.reactions[i+1:]...)
+					break
+				}
+			}
+		} else {
+			m.reactions = append(m.reactions, text)
+		}
+	}
+	return msgs, nil
+}
+
+const messageTimeFormat = "2006-01-02 15:04:05"
+
+func writeConversationText(w io.Writer, c *conversation, msgs []*message) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\n\n", c.title)
+	for _, m := range msgs {
+		fmt.Fprintf(&b, "[%s] %s", m.date.Local().Format(messageTimeFormat), m.sender)
+		if m.service != "" {
+			fmt.Fprintf(&b, " (%s)", m.service)
+		}
+		b.WriteString(":")
+		if m.text != "" {
+			b.WriteString(" " + strings.ReplaceAll(m.text, "\n", "\n    "))
+		}
+		b.WriteString("\n")
+		for _, a := range m.attachments {
+			fmt.Fprintf(&b, "    [Attachment: Attachments/%s]\n", a)
+		}
+		if len(m.reactions) > 0 {
+			fmt.Fprintf(&b, "    [%s]\n", strings.Join(m.reactions, ", "))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeConversationHTML(w io.Writer, c *conversation, msgs []*message) error {
+	var b strings.Builder
+	title := html.EscapeString(c.title)
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: auto; }
+.msg { margin: 0.5em 0; padding: 0.4em 0.8em; border-radius: 1em; background: #e5e5ea; max-width: 70%%; }
+.me { margin-left: auto; background: #0b84fe; color: white; }
+.me a { color: white; }
+.meta { font-size: 0.75em; opacity: 0.7; }
+.reactions { font-size: 0.8em; font-style: italic; }
+img { max-width: 100%%; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+`, title, title)
+
+	for _, m := range msgs {
+		class := "msg"
+		if m.fromMe {
+			class += " me"
+		}
+		fmt.Fprintf(&b, "<div class=\"%s\">\n<div class=\"meta\">%s &middot; %s",
+			class, html.EscapeString(m.sender), m.date.Local().Format(messageTimeFormat))
+		if m.service != "" {
+			fmt.Fprintf(&b, " &middot; %s", html.EscapeString(m.service))
+		}
+		b.WriteString("</div>\n")
+		if m.text != "" {
+			fmt.Fprintf(&b, "<div>%s</div>\n", strings.ReplaceAll(html.EscapeString(m.text), "\n", "<br>\n"))
+		}
+		for _, a := range m.attachments {
+			href := "Attachments/" + url.PathEscape(a)
+			if inlineImages[strings.ToLower(filepath.Ext(a))] {
+				fmt.Fprintf(&b, "<div><a href=\"%s\"><img src=\"%s\" alt=\"%s\"></a></div>\n", href, href, html.EscapeString(a))
+			} else {
+				fmt.Fprintf(&b, "<div><a href=\"%s\">%s</a></div>\n", href, html.EscapeString(a))
+			}
+		}
+		if len(m.reactions) > 0 {
+			fmt.Fprintf(&b, "<div class=\"reactions\">%s</div>\n", html.EscapeString(strings.Join(m.reactions, ", ")))
+		}
+		b.WriteString("</div>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
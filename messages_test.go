@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageTime(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want time.Time
+	}{
+		{0, appleEpoch},
+		{600000000, time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC)},
+		{600000000 * 1e9, time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC)},
+		{600000000*1e9 + 500, time.Date(2020, 1, 6, 10, 40, 0, 500, time.UTC)},
+	}
+	for _, tt := range tests {
+		if got := messageTime(tt.v); !got.Equal(tt.want) {
+			t.Errorf("messageTime(%d) = %v, want %v", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestAttributedText(t *testing.T) {
+	// The string follows the NSString class name, after a '+' and its length
+	header := "\x04\x0bstreamtyped\x81\xe8\x03\x84\x01@\x84\x84\x84\x12NSAttributedString\x00\x84\x84\x08NSObject\x00\x85\x92\x84\x84\x84\x08NSString\x01\x94\x84\x01+"
+	long := strings.Repeat("x", 300)
+	huge := strings.Repeat("y", 70000)
+
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{"short", header + "\x05Hello\x86\x84\x02iI", "Hello"},
+		{"empty", header + "\x00\x86", ""},
+		{"utf-8", header + "\x06caf\xc3\xa9!", "café!"},
+		{"two byte length", header + "\x81\x2c\x01" + long + "\x86", long},
+		{"four byte length", header + "\x82\x70\x11\x01\x00" + huge, huge},
+		{"truncated", header + "\x09Hello", ""},
+		{"no length", header, ""},
+		{"no string", "\x04\x0bstreamtyped\x81\xe8\x03", ""},
+		{"no plus", "NSString\x01\x94", ""},
+	}
+	for _, tt := range tests {
+		if got := attributedText([]byte(tt.data)); got != tt.want {
+			t.Errorf("%s: got %.20q, want %.20q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteConversationText(t *testing.T) {
+	saved := time.Local
+	defer func() { time.Local = saved }()
+	time.Local = time.UTC
+
+	date := time.Date(2020, 1, 5, 10, 40, 0, 0, time.UTC)
+	c := &conversation{title: "Alice & Bob"}
+
+	tests := []struct {
+		name string
+		msg  message
+		want string
+	}{
+		{
+			name: "text",
+			msg:  message{date: date, sender: "Alice", service: "iMessage", text: "Hi"},
+			want: "[2020-01-05 10:40:00] Alice (iMessage): Hi\n",
+		},
+		{
+			name: "lines",
+			msg:  message{date: date, sender: "Me", fromMe: true, text: "one\ntwo"},
+			want: "[2020-01-05 10:40:00] Me: one\n    two\n",
+		},
+		{
+			name: "attachments and reactions",
+			msg: message{date: date, sender: "Bob", service: "SMS", attachments: []string{"IMG_0001.jpg"},
+				reactions: []string{"Loved by Alice", "Liked by Me"}},
+			want: "[2020-01-05 10:40:00] Bob (SMS):\n    [Attachment: Attachments/IMG_0001.jpg]\n    [Loved by Alice, Liked by Me]\n",
+		},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := writeConversationText(&b, c, []*message{&tt.msg}); err != nil {
+			t.Fatal(err)
+		}
+		if want := "Alice & Bob\n\n" + tt.want; b.String() != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, b.String(), want)
+		}
+	}
+}
+
+func TestWriteConversationHTML(t *testing.T) {
+	saved := time.Local
+	defer func() { time.Local = saved }()
+	time.Local = time.UTC
+
+	date := time.Date(2020, 1, 5, 10, 40, 0, 0, time.UTC)
+	c := &conversation{title: "Alice & Bob"}
+
+	tests := []struct {
+		name string
+		msg  message
+		want []string
+	}{
+		{
+			name: "escaped",
+			msg:  message{date: date, sender: "<Alice>", service: "iMessage", text: "a < b\nc"},
+			want: []string{
+				"<title>Alice &amp; Bob</title>",
+				`<div class="msg">`,
+				"&lt;Alice&gt; &middot; 2020-01-05 10:40:00 &middot; iMessage</div>",
+				"<div>a &lt; b<br>\nc</div>",
+			},
+		},
+		{
+			name: "from me",
+			msg:  message{date: date, sender: "Me", fromMe: true, reactions: []string{"Loved by Alice"}},
+			want: []string{`<div class="msg me">`, `<div class="reactions">Loved by Alice</div>`},
+		},
+		{
+			name: "attachments",
+			msg:  message{date: date, sender: "Bob", attachments: []string{"My Photo.JPG", "notes #1.pdf"}},
+			want: []string{
+				`<a href="Attachments/My%20Photo.JPG"><img src="Attachments/My%20Photo.JPG" alt="My Photo.JPG"></a>`,
+				`<a href="Attachments/notes%20%231.pdf">notes #1.pdf</a>`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := writeConversationHTML(&b, c, []*message{&tt.msg}); err != nil {
+			t.Fatal(err)
+		}
+		for _, w := range tt.want {
+			if !strings.Contains(b.String(), w) {
+				t.Errorf("%s: %q not found in\n%s", tt.name, w, b.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Collision policies, selected with -collide
+const (
+	collideSuffix = "suffix"
+	collideID     = "id"
+	collideFail   = "fail"
+)
+
+func validCollision(c string) bool {
+	switch c {
+	case collideSuffix, collideID, collideFail:
+		return true
+	}
+	return false
+}
+
+// splitExt splits name into its base and extension (including the dot).  Leading dots are
+// part of the base, so dotfiles such as ".profile" have no extension.
+func splitExt(name string) (base, ext string) {
+	i := strings.LastIndexByte(name, '.')
+	if i <= 0 || strings.TrimLeft(name[:i], ".") == "" {
+		return name, ""
+	}
+	return name[:i], name[i:]
+}
+
+// altName returns the n'th alternative for name, used when name is already taken.  The
+// "suffix" policy gives "IMG_0001 (1).JPG", while the "id" policy includes the start of the
+// file id instead, as in "IMG_0001 [3b2a9f01].JPG", falling back to a numbered suffix if that
+// is taken too.  Directories (which have no id) always use a numbered suffix.
+func altName(name, id string, n int) string {
+	base, ext := splitExt(name)
+	if global.Collision == collideID && id != "" {
+		if len(id) > 8 {
+			id = id[0:8]
+		}
+		if n == 1 {
+			return fmt.Sprintf("%s [%s]%s", base, id, ext)
+		}
+		return fmt.Sprintf("%s [%s] (%d)%s", base, id, n-1, ext)
+	}
+	return fmt.Sprintf("%s (%d)%s", base, n, ext)
+}
+
+// Unicode normalisation forms, selected with -norm
+const (
+	normNone = "none"
+	normNFC  = "nfc"
+	normNFD  = "nfd"
+)
+
+// Escaping schemes, selected with -escape
+const (
+	escapeAuto    = "auto"
+	escapeNone    = "none"
+	escapeWindows = "windows"
+)
+
+func validNames(norm, escape string) bool {
+	switch norm {
+	case normNone, normNFC, normNFD:
+	default:
+		return false
+	}
+	switch escape {
+	case escapeAuto, escapeNone, escapeWindows:
+		return true
+	}
+	return false
+}
+
+// sfmChars maps characters which are not allowed in Windows file names to the private use
+// characters used by Services for Mac (and Samba's catia/fruit modules) for the same purpose.
+// Control characters 0x01-0x1f map to U+F001-U+F01F.
+var sfmChars = map[rune]rune{
+	'"':  0xf020,
+	'*':  0xf021,
+	':':  0xf022,
+	'<':  0xf023,
+	'>':  0xf024,
+	'?':  0xf025,
+	'\\': 0xf026,
+	'|':  0xf027,
+}
+
+// Trailing spaces and periods are stripped by Windows, so are mapped as well.
+const (
+	sfmSpace  = 0xf028
+	sfmPeriod = 0xf029
+)
+
+// sfmQuote precedes private use characters which were already in the name, so that they are
+// not mistaken for escaped ones.
+const sfmQuote = 0xf000
+
+// escapeName replaces the characters of name which Windows does not allow.  Characters in
+// U+F000-U+F029 are quoted with a U+F000 before them, so the original name can always be
+// recovered with unescapeName.
+func escapeName(name string) string {
+	r := []rune(name)
+	end := len(r)
+	for end > 0 && (r[end-1] == ' ' || r[end-1] == '.') {
+		end--
+	}
+
+	e := make([]rune, 0, len(r))
+	for i, c := range r {
+		m, ok := sfmChars[c]
+		switch {
+		case ok:
+			e = append(e, m)
+		case c > 0 && c < 0x20:
+			e = append(e, sfmQuote+c)
+		case c >= sfmQuote && c <= sfmPeriod:
+			e = append(e, sfmQuote, c)
+		case i >= end && c == ' ':
+			e = append(e, sfmSpace)
+		case i >= end:
+			e = append(e, sfmPeriod)
+		default:
+			e = append(e, c)
+		}
+	}
+	return string(e)
+}
+
+// unescapeName reverses escapeName.
+func unescapeName(name string) string {
+	r := []rune(name)
+	u := make([]rune, 0, len(r))
+	for i := 0; i < len(r); i++ {
+		c := r[i]
+		switch {
+		case c == sfmQuote && i+1 < len(r):
+			i++
+			c = r[i]
+		case c > sfmQuote && c < 0xf020:
+			c -= sfmQuote
+		case c == sfmSpace:
+			c = ' '
+		case c == sfmPeriod:
+			c = '.'
+		default:
+			for k, v := range sfmChars {
+				if c == v {
+					c = k
+				}
+			}
+		}
+		u = append(u, c)
+	}
+	return string(u)
+}
+
+// mapName converts a name from the backup to the name presented, applying the selected
+// normalisation, lowercasing and escaping in that order.
+func mapName(name string) string {
+	switch global.Normalize {
+	case normNFC:
+		name = norm.NFC.String(name)
+	case normNFD:
+		name = norm.NFD.String(name)
+	}
+
+	if global.LowerCase {
+		name = strings.ToLower(name)
+	}
+
+	escape := global.Escape
+	if escape == escapeAuto {
+		escape = escapeNone
+		if runtime.GOOS == "windows" {
+			escape = escapeWindows
+		}
+	}
+	if escape == escapeWindows {
+		name = escapeName(name)
+	}
+	return name
+}
+
+// safeName converts a name which did not come from a path in the backup (such as an app or
+// table name) into a file name, replacing any slashes before mapping it as usual.
+func safeName(name string) string {
+	return mapName(strings.ReplaceAll(name, "/", "_"))
+}
+
+// uniqueName returns name, or the first alternative name not already used in d, for
+// entries added by views.
+func uniqueName(d *DirNode, name string) string {
+	unique := name
+	for n := 1; ; n++ {
+		if _, ok := d.entries[unique]; !ok {
+			return unique
+		}
+		unique = altName(name, "", n)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// addNames adds files with the given ids and paths to an empty directory, returning the names
+// of its entries.
+func addNames(files [][2]string) ([]string, error) {
+	root := &DirNode{
+		inode:   nextID(),
+		entries: make(map[string]NodeEntry),
+	}
+	for _, f := range files {
+		if err := root.Add(f[0], "HomeDomain", f[1]); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make([]string, 0, len(root.entries))
+	for name := range root.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func TestCollisions(t *testing.T) {
+	const (
+		id1 = "3b2a9f01c4d5e6f708192a3b4c5d6e7f80910a1b"
+		id2 = "5e6f7081a2b3c4d5e6f708192a3b4c5d6e7f8091"
+		id3 = "5e6f70819f8e7d6c5b4a392817061f5e4d3c2b1a"
+	)
+	tests := []struct {
+		name      string
+		lower     bool
+		collision string
+		files     [][2]string
+		want      []string
+	}{
+		{
+			name:      "lowercase",
+			lower:     true,
+			collision: collideSuffix,
+			files:     [][2]string{{id1, "IMG_1.JPG"}, {id2, "img_1.jpg"}},
+			want:      []string{"img_1 (1).jpg", "img_1.jpg"},
+		},
+		{
+			name:      "dotfile",
+			collision: collideSuffix,
+			files:     [][2]string{{id1, ".profile"}, {id2, ".profile"}},
+			want:      []string{".profile", ".profile (1)"},
+		},
+		{
+			name:      "no extension",
+			collision: collideSuffix,
+			files:     [][2]string{{id1, "README"}, {id2, "README"}},
+			want:      []string{"README", "README (1)"},
+		},
+		{
+			name:      "numbered",
+			collision: collideSuffix,
+			files:     [][2]string{{id1, "a.txt"}, {id2, "a.txt"}, {id3, "a.txt"}},
+			want:      []string{"a (1).txt", "a (2).txt", "a.txt"},
+		},
+		{
+			name:      "id",
+			collision: collideID,
+			files:     [][2]string{{id1, "IMG_1.JPG"}, {id2, "IMG_1.JPG"}, {id3, "IMG_1.JPG"}},
+			want:      []string{"IMG_1 [5e6f7081] (1).JPG", "IMG_1 [5e6f7081].JPG", "IMG_1.JPG"},
+		},
+		{
+			name:      "id dotfile",
+			collision: collideID,
+			files:     [][2]string{{id1, ".profile"}, {id2, ".profile"}},
+			want:      []string{".profile", ".profile [5e6f7081]"},
+		},
+	}
+
+	saved := global
+	defer func() { global = saved }()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global.LowerCase = tt.lower
+			global.Collision = tt.collision
+			global.DomainDirs = false
+			got, err := addNames(tt.files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollisionFail(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+	global.Collision = collideFail
+	global.DomainDirs = false
+
+	_, err := addNames([][2]string{{"1", "a.txt"}, {"2", "a.txt"}})
+	if err == nil || !strings.Contains(err.Error(), "duplicate file name: a.txt") {
+		t.Errorf("got %v, want a duplicate file name error", err)
+	}
+}
+
+func TestEscapeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"plain.txt", "plain.txt"},
+		{`a:b?c*d"e<f>g|h\i`, "a\uf022b\uf025c\uf021d\uf020e\uf023f\uf024g\uf027h\uf026i"},
+		{"tab\there", "tab\uf009here"},
+		{"trailing. .", "trailing\uf029\uf028\uf029"},
+		{"inner. dots.txt", "inner. dots.txt"},
+		{"...", "\uf029\uf029\uf029"},
+		{"\uf022colon", "\uf000\uf022colon"},
+		{"\uf000quote", "\uf000\uf000quote"},
+		{"space\uf028 ", "space\uf000\uf028\uf028"},
+		{"\uf02a outside", "\uf02a outside"},
+	}
+	for _, tt := range tests {
+		got := escapeName(tt.name)
+		if got != tt.want {
+			t.Errorf("escapeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if back := unescapeName(got); back != tt.name {
+			t.Errorf("unescapeName(%q) = %q, want %q", got, back, tt.name)
+		}
+	}
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf16"
+)
+
+// Top level directory presenting the notes.
+const notesDir = "Notes"
+
+// Location of the notes database in the backup (iOS 9 and later).
+const (
+	notesDomain = "AppDomainGroup-group.com.apple.notes"
+	notesPath   = "NoteStore.sqlite"
+)
+
+// Paragraph styles of the lines of a note.  Lines without a style are body text.
+const (
+	styleBody       = -1
+	styleTitle      = 0
+	styleHeading    = 1
+	styleSubheading = 2
+	styleMonospace  = 4
+	styleDotted     = 100
+	styleDashed     = 101
+	styleNumbered   = 102
+	styleChecklist  = 103
+)
+
+// Font weights of text in a note.
+const (
+	weightBold       = 1
+	weightItalic     = 2
+	weightBoldItalic = 3
+)
+
+// noteSpan is a run of text in a note with the same formatting.
+type noteSpan struct {
+	text                            string
+	bold, italic, underline, strike bool
+	link                            string
+	attachment                      string
+}
+
+// noteLine is a paragraph of a note.
+type noteLine struct {
+	style   int
+	indent  int
+	checked bool
+	spans   []noteSpan
+}
+
+// noteAttachment is something embedded in a note.  Files are shared from the backup, in the
+// Attachments directory next to the note.
+type noteAttachment struct {
+	file  string
+	url   string
+	text  string
+	title string
+}
+
+// noteInfo is a note waiting to be rendered.
+type noteInfo struct {
+	pk          int64
+	title       string
+	locked      bool
+	attachments map[string]*noteAttachment
+}
+
+// addNotesView adds Notes/<Account>/<Folder>/ with each note as Markdown and HTML.  The notes
+// database is read when the directory is first opened, and each note when it is opened.
+func addNotesView(root *DirNode) error {
+	addViewDir(root, notesDir, func(d *DirNode) error {
+		return populateNotes(root, d)
+	})
+	return nil
+}
+
+// notesEntities returns the entity number of each type of object in the database.  Accounts,
+// folders, notes and attachments are all held in the same table.
+func notesEntities(db *sql.DB) (map[string]int, error) {
+	r, err := db.Query("select Z_ENT, Z_NAME from Z_PRIMARYKEY")
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	ents := make(map[string]int)
+	for r.Next() {
+		var ent int
+		var name string
+		if err := r.Scan(&ent, &name); err != nil {
+			return nil, err
+		}
+		ents[name] = ent
+	}
+	return ents, r.Err()
+}
+
+func populateNotes(root, d *DirNode) error {
+	file, err := backupDB(root, notesDomain, notesPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ents, err := notesEntities(db)
+	if err != nil {
+		return err
+	}
+
+	const table = "ZICCLOUDSYNCINGOBJECT"
+	col := func(names ...string) string {
+		expr := "''"
+		for i := len(names) - 1; i >= 0; i-- {
+			expr = columnOr(db, table, names[i], expr)
+		}
+		return expr
+	}
+	num := func(name string) string { return columnOr(db, table, name, "0") }
+
+	// Accounts hold folders, which may be nested
+	accounts := make(map[int64]*DirNode)
+	r, err := db.Query("select Z_PK, "+col("ZNAME")+" from "+table+" where Z_ENT=?", ents["ICAccount"])
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		var pk int64
+		var name string
+		if err := r.Scan(&pk, &name); err != nil {
+			r.Close()
+			return err
+		}
+		if name == "" {
+			name = "Notes"
+		}
+		accounts[pk] = d.Subdir(uniqueName(d, safeName(name)), notesDomain)
+	}
+	r.Close()
+
+	type folder struct {
+		title         string
+		parent, owner int64
+		dir           *DirNode
+	}
+	folders := make(map[int64]*folder)
+	r, err = db.Query("select Z_PK, "+col("ZTITLE2", "ZTITLE")+", "+num("ZPARENT")+", "+num("ZOWNER")+
+		" from "+table+" where Z_ENT=?", ents["ICFolder"])
+	if err != nil {
+		return err
+	}
+	for r.Next() {
+		f := &folder{}
+		var pk int64
+		if err := r.Scan(&pk, &f.title, &f.parent, &f.owner); err != nil {
+			r.Close()
+			return err
+		}
+		folders[pk] = f
+	}
+	r.Close()
+
+	var folderDir func(pk int64, depth int) *DirNode
+	folderDir = func(pk int64, depth int) *DirNode {
+		f, ok := folders[pk]
+		if !ok || depth > len(folders) {
+			return nil
+		}
+		if f.dir == nil {
+			parent := folderDir(f.parent, depth+1)
+			if parent == nil {
+				if parent = accounts[f.owner]; parent == nil {
+					parent = d
+				}
+			}
+			title := f.title
+			if title == "" {
+				title = "Folder"
+			}
+			f.dir = parent.Subdir(uniqueName(parent, safeName(title)), notesDomain)
+		}
+		return f.dir
+	}
+
+	attachments, err := readNoteAttachments(db, ents["ICAttachment"], ents["ICMedia"], col, num)
+	if err != nil {
+		debug("Note attachments: %v", err)
+	}
+
+	r, err = db.Query("select Z_PK, "+col("ZTITLE1", "ZTITLE")+", "+num("ZFOLDER")+", "+num("ZISPASSWORDPROTECTED")+
+		" from "+table+" where Z_ENT=? and "+num("ZMARKEDFORDELETION")+"=0 order by Z_PK", ents["ICNote"])
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var folderPK int64
+		n := &noteInfo{attachments: make(map[string]*noteAttachment)}
+		if err := r.Scan(&n.pk, &n.title, &folderPK, &n.locked); err != nil {
+			return err
+		}
+
+		dir := folderDir(folderPK, 0)
+		if dir == nil {
+			dir = d
+		}
+		title := strings.TrimSpace(n.title)
+		if title == "" {
+			title = "Untitled"
+		}
+		base := strings.TrimSuffix(uniqueName(dir, safeName(title)+".md"), ".md")
+
+		// In order of id, so attachments keep their names from one mount to the next
+		ids := make([]string, 0, len(attachments[n.pk]))
+		for id := range attachments[n.pk] {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			n.attachments[id] = resolveNoteAttachment(root, dir, attachments[n.pk][id])
+		}
+
+		for _, ext := range []string{".md", ".html"} {
+			name, ext := base+ext, ext
+			dir.entries[name] = newVirtualWriter(name, notesDomain, func(w io.Writer) error {
+				return writeNote(w, file, n, ext)
+			})
+		}
+	}
+	return r.Err()
+}
+
+// noteAttachmentRow is an attachment as found in the database, before finding its file.
+type noteAttachmentRow struct {
+	id, url, alt, title string
+	media, filename     string
+}
+
+// readNoteAttachments reads the attachments of all notes, keyed by note and attachment id.
+func readNoteAttachments(db *sql.DB, attEnt, mediaEnt int, col func(...string) string,
+	num func(string) string) (map[int64]map[string]*noteAttachmentRow, error) {
+	const table = "ZICCLOUDSYNCINGOBJECT"
+
+	media := make(map[int64][2]string)
+	r, err := db.Query("select Z_PK, "+col("ZIDENTIFIER")+", "+col("ZFILENAME")+" from "+table+" where Z_ENT=?", mediaEnt)
+	if err != nil {
+		return nil, err
+	}
+	for r.Next() {
+		var pk int64
+		var id, filename string
+		if err := r.Scan(&pk, &id, &filename); err != nil {
+			r.Close()
+			return nil, err
+		}
+		media[pk] = [2]string{id, filename}
+	}
+	r.Close()
+
+	r, err = db.Query("select "+num("ZNOTE")+", "+col("ZIDENTIFIER")+", "+col("ZURLSTRING")+", "+
+		col("ZALTTEXT")+", "+col("ZTITLE")+", "+num("ZMEDIA")+" from "+table+" where Z_ENT=?", attEnt)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	list := make(map[int64]map[string]*noteAttachmentRow)
+	for r.Next() {
+		var note, mediaPK int64
+		a := &noteAttachmentRow{}
+		if err := r.Scan(&note, &a.id, &a.url, &a.alt, &a.title, &mediaPK); err != nil {
+			return nil, err
+		}
+		if m, ok := media[mediaPK]; ok {
+			a.media, a.filename = m[0], m[1]
+		}
+		if list[note] == nil {
+			list[note] = make(map[string]*noteAttachmentRow)
+		}
+		list[note][a.id] = a
+	}
+	return list, r.Err()
+}
+
+// resolveNoteAttachment finds the file of an attachment in the backup, adding it to the
+// Attachments directory in dir.  Media are kept in a directory named after their id, while
+// drawings and scans have a rendered image named after the attachment.
+func resolveNoteAttachment(root, dir *DirNode, a *noteAttachmentRow) *noteAttachment {
+	na := &noteAttachment{url: a.url, text: a.alt, title: a.title}
+
+	var patterns []string
+	if a.media != "" {
+		patterns = append(patterns, "%Media/"+a.media+"/%")
+	}
+	if a.id != "" {
+		patterns = append(patterns, "%FallbackImages/"+a.id+"%")
+	}
+
+	for _, p := range patterns {
+		paths, err := global.db.FindFiles(notesDomain, p)
+		if err != nil || len(paths) == 0 {
+			continue
+		}
+		found := paths[0]
+		for _, p := range paths {
+			if a.filename != "" && path.Base(p) == a.filename {
+				found = p
+			}
+		}
+
+		f, err := backupFile(root, notesDomain, found)
+		if err != nil {
+			debug("Note attachment %s: %v", a.id, err)
+			continue
+		}
+		atts := dir.Subdir("Attachments", notesDomain)
+		na.file = uniqueName(atts, safeName(path.Base(found)))
+		atts.entries[na.file] = f
+		f.links++
+		break
+	}
+	return na
+}
+
+// decodeNote decodes the gzipped protocol buffer holding the text of a note into lines.
+// The text is split into runs of the same formatting, measured in UTF-16 code units.
+func decodeNote(data []byte) ([]noteLine, error) {
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		z, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(z); err != nil {
+			return nil, err
+		}
+	}
+
+	store, err := parseProto(data)
+	if err != nil {
+		return nil, err
+	}
+	doc := store.message(2).message(3)
+	text := utf16.Encode([]rune(doc.string(2)))
+
+	var lines []noteLine
+	cur := noteLine{style: styleBody}
+	pos := 0
+
+	add := func(seg string, style noteLine, span noteSpan) {
+		parts := strings.Split(seg, "\n")
+		for i, p := range parts {
+			if p != "" {
+				span.text = p
+				cur.spans = append(cur.spans, span)
+			}
+			// The paragraph style is that of the whole line, including the newline
+			cur.style, cur.indent, cur.checked = style.style, style.indent, style.checked
+			if i < len(parts)-1 {
+				lines = append(lines, cur)
+				cur = noteLine{style: styleBody}
+			}
+		}
+	}
+
+	for _, run := range doc.messages(5) {
+		n := int(run.uint(1))
+		if pos+n > len(text) {
+			n = len(text) - pos
+		}
+		seg := string(utf16.Decode(text[pos : pos+n]))
+		pos += n
+
+		ps := run.message(2)
+		style := noteLine{style: styleBody, indent: int(ps.uint(4)), checked: ps.message(5).uint(2) == 1}
+		if ps.has(1) {
+			style.style = int(ps.uint(1))
+		}
+
+		weight := run.uint(5)
+		add(seg, style, noteSpan{
+			bold:       weight == weightBold || weight == weightBoldItalic,
+			italic:     weight == weightItalic || weight == weightBoldItalic,
+			underline:  run.uint(6) == 1,
+			strike:     run.uint(7) == 1,
+			link:       run.string(9),
+			attachment: run.message(12).string(1),
+		})
+	}
+	if pos < len(text) {
+		add(string(utf16.Decode(text[pos:])), noteLine{style: styleBody}, noteSpan{})
+	}
+	if len(cur.spans) > 0 {
+		lines = append(lines, cur)
+	}
+	return lines, nil
+}
+
+// writeNote renders a note as Markdown or HTML.
+func writeNote(w io.Writer, file string, n *noteInfo, ext string) error {
+	var lines []noteLine
+	if n.locked {
+		lines = []noteLine{{style: styleBody, spans: []noteSpan{{text: "This note is locked."}}}}
+	} else {
+		db, err := openSQLite(file)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		var data []byte
+		if err := db.QueryRow("select ZDATA from ZICNOTEDATA where ZNOTE=?", n.pk).Scan(&data); err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if lines, err = decodeNote(data); err != nil {
+			return fmt.Errorf("%s: %w", n.title, err)
+		}
+	}
+
+	var out string
+	if ext == ".html" {
+		out = noteHTML(n, lines)
+	} else {
+		out = noteMarkdown(n, lines)
+	}
+	_, err := io.WriteString(w, out)
+	return err
+}
+
+// isImage reports whether an attachment can be shown as an image.
+func (a *noteAttachment) isImage() bool {
+	return a.file != "" && inlineImages[strings.ToLower(filepath.Ext(a.file))]
+}
+
+func (a *noteAttachment) label() string {
+	switch {
+	case a.title != "":
+		return a.title
+	case a.file != "":
+		return a.file
+	case a.url != "":
+		return a.url
+	}
+	return "Attachment"
+}
+
+// linkSchemes are the URL schemes of links kept from notes, leaving out any (such as
+// javascript:) which would run when the HTML is opened.
+var linkSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+}
+
+// safeLink reports whether link uses one of linkSchemes.
+func safeLink(link string) bool {
+	u, err := url.Parse(link)
+	return err == nil && linkSchemes[strings.ToLower(u.Scheme)]
+}
+
+// isList reports whether a paragraph style is a list item.
+func isList(style int) bool {
+	return style >= styleDotted && style <= styleChecklist
+}
+
+// mdSpan renders a span as Markdown, keeping surrounding spaces outside the markers.
+func mdSpan(s noteSpan, atts map[string]*noteAttachment) string {
+	if s.attachment != "" {
+		a, ok := atts[s.attachment]
+		switch {
+		case !ok:
+			return "[Attachment]"
+		case a.isImage():
+			return "![" + a.label() + "](Attachments/" + url.PathEscape(a.file) + ")"
+		case a.file != "":
+			return "[" + a.label() + "](Attachments/" + url.PathEscape(a.file) + ")"
+		case safeLink(a.url):
+			return "[" + a.label() + "](" + a.url + ")"
+		case a.text != "":
+			return a.text
+		}
+		return "[" + a.label() + "]"
+	}
+
+	core := strings.TrimSpace(s.text)
+	if core == "" {
+		return s.text
+	}
+	lead := s.text[:strings.Index(s.text, core)]
+	trail := s.text[len(lead)+len(core):]
+	if s.strike {
+		core = "~~" + core + "~~"
+	}
+	if s.italic {
+		core = "*" + core + "*"
+	}
+	if s.bold {
+		core = "**" + core + "**"
+	}
+	if safeLink(s.link) {
+		core = "[" + core + "](" + s.link + ")"
+	}
+	return lead + core + trail
+}
+
+func noteMarkdown(n *noteInfo, lines []noteLine) string {
+	var b strings.Builder
+	prev := styleBody
+	for i, l := range lines {
+		var text strings.Builder
+		for _, s := range l.spans {
+			if l.style == styleMonospace {
+				text.WriteString(s.text)
+			} else {
+				text.WriteString(mdSpan(s, n.attachments))
+			}
+		}
+		content := text.String()
+
+		// Code blocks and lists run on, while other paragraphs are separated by a blank line
+		if l.style == styleMonospace && prev != styleMonospace {
+			if i > 0 {
+				b.WriteString("\n")
+			}
+			b.WriteString("```\n")
+		}
+		if prev == styleMonospace && l.style != styleMonospace {
+			b.WriteString("```\n")
+		}
+		if l.style != styleMonospace && i > 0 && !(isList(l.style) && isList(prev)) {
+			if strings.TrimSpace(content) == "" {
+				prev = l.style
+				continue
+			}
+			b.WriteString("\n")
+		}
+
+		indent := strings.Repeat("  ", l.indent)
+		switch l.style {
+		case styleTitle:
+			b.WriteString("# ")
+		case styleHeading:
+			b.WriteString("## ")
+		case styleSubheading:
+			b.WriteString("### ")
+		case styleDotted, styleDashed:
+			b.WriteString(indent + "- ")
+		case styleNumbered:
+			b.WriteString(indent + "1. ")
+		case styleChecklist:
+			if l.checked {
+				b.WriteString(indent + "- [x] ")
+			} else {
+				b.WriteString(indent + "- [ ] ")
+			}
+		}
+		b.WriteString(content + "\n")
+		prev = l.style
+	}
+	if prev == styleMonospace {
+		b.WriteString("```\n")
+	}
+	return b.String()
+}
+
+// htmlSpan renders a span as HTML.
+func htmlSpan(s noteSpan, atts map[string]*noteAttachment) string {
+	if s.attachment != "" {
+		a, ok := atts[s.attachment]
+		switch {
+		case !ok:
+			return "[Attachment]"
+		case a.isImage():
+			href := "Attachments/" + url.PathEscape(a.file)
+			return fmt.Sprintf(`<a href="%s"><img src="%s" alt="%s"></a>`, href, href, html.EscapeString(a.label()))
+		case a.file != "":
+			return fmt.Sprintf(`<a href="Attachments/%s">%s</a>`, url.PathEscape(a.file), html.EscapeString(a.label()))
+		case safeLink(a.url):
+			return fmt.Sprintf(`<a href="%s">%s</a>`, html.EscapeString(a.url), html.EscapeString(a.label()))
+		case a.text != "":
+			return html.EscapeString(a.text)
+		}
+		return "[" + html.EscapeString(a.label()) + "]"
+	}
+
+	t := html.EscapeString(s.text)
+	if s.strike {
+		t = "<s>" + t + "</s>"
+	}
+	if s.underline {
+		t = "<u>" + t + "</u>"
+	}
+	if s.italic {
+		t = "<i>" + t + "</i>"
+	}
+	if s.bold {
+		t = "<b>" + t + "</b>"
+	}
+	if safeLink(s.link) {
+		t = `<a href="` + html.EscapeString(s.link) + `">` + t + "</a>"
+	}
+	return t
+}
+
+func noteHTML(n *noteInfo, lines []noteLine) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: auto; }
+ul.checklist { list-style: none; }
+img { max-width: 100%%; }
+</style>
+</head>
+<body>
+`, html.EscapeString(n.title))
+
+	// Consecutive list items and monospaced lines are grouped into one element
+	open := ""
+	closeGroup := func() {
+		if open != "" {
+			b.WriteString("</" + strings.Fields(open)[0] + ">\n")
+			open = ""
+		}
+	}
+	group := func(tag string) {
+		if open != tag {
+			closeGroup()
+			b.WriteString("<" + tag + ">\n")
+			open = tag
+		}
+	}
+
+	for _, l := range lines {
+		var text strings.Builder
+		for _, s := range l.spans {
+			if l.style == styleMonospace {
+				text.WriteString(html.EscapeString(s.text))
+			} else {
+				text.WriteString(htmlSpan(s, n.attachments))
+			}
+		}
+		content := text.String()
+
+		item := "<li>"
+		if l.indent > 0 {
+			item = fmt.Sprintf(`<li style="margin-left: %dem">`, l.indent*2)
+		}
+		switch l.style {
+		case styleTitle:
+			closeGroup()
+			b.WriteString("<h1>" + content + "</h1>\n")
+		case styleHeading:
+			closeGroup()
+			b.WriteString("<h2>" + content + "</h2>\n")
+		case styleSubheading:
+			closeGroup()
+			b.WriteString("<h3>" + content + "</h3>\n")
+		case styleMonospace:
+			if open != "pre" {
+				closeGroup()
+				b.WriteString("<pre>")
+				open = "pre"
+			}
+			b.WriteString(content + "\n")
+		case styleDotted, styleDashed:
+			group("ul")
+			b.WriteString(item + content + "</li>\n")
+		case styleNumbered:
+			group("ol")
+			b.WriteString(item + content + "</li>\n")
+		case styleChecklist:
+			group(`ul class="checklist"`)
+			check := `<input type="checkbox" disabled> `
+			if l.checked {
+				check = `<input type="checkbox" disabled checked> `
+			}
+			b.WriteString(item + check + content + "</li>\n")
+		default:
+			closeGroup()
+			if strings.TrimSpace(content) != "" {
+				b.WriteString("<p>" + content + "</p>\n")
+			}
+		}
+	}
+	closeGroup()
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"reflect"
+	"testing"
+)
+
+func TestNoteLinks(t *testing.T) {
+	atts := map[string]*noteAttachment{
+		"web":    {url: "https://example.com/a?b=1&c=2", title: "Example"},
+		"script": {url: "javascript:alert(1)"},
+		"mail":   {url: "MAILTO:someone@example.com"},
+	}
+	tests := []struct {
+		name string
+		span noteSpan
+		md   string
+		html string
+	}{
+		{
+			name: "http",
+			span: noteSpan{text: "site", link: "http://example.com"},
+			md:   "[site](http://example.com)",
+			html: `<a href="http://example.com">site</a>`,
+		},
+		{
+			name: "javascript",
+			span: noteSpan{text: "click", link: "javascript:alert(1)"},
+			md:   "click",
+			html: "click",
+		},
+		{
+			name: "data",
+			span: noteSpan{text: "x", bold: true, link: "data:text/html,<script>alert(1)</script>"},
+			md:   "**x**",
+			html: "<b>x</b>",
+		},
+		{
+			name: "relative",
+			span: noteSpan{text: "doc", link: "other.html"},
+			md:   "doc",
+			html: "doc",
+		},
+		{
+			name: "attachment",
+			span: noteSpan{attachment: "web"},
+			md:   "[Example](https://example.com/a?b=1&c=2)",
+			html: `<a href="https://example.com/a?b=1&amp;c=2">Example</a>`,
+		},
+		{
+			name: "attachment mailto",
+			span: noteSpan{attachment: "mail"},
+			md:   "[MAILTO:someone@example.com](MAILTO:someone@example.com)",
+			html: `<a href="MAILTO:someone@example.com">MAILTO:someone@example.com</a>`,
+		},
+		{
+			name: "attachment javascript",
+			span: noteSpan{attachment: "script"},
+			md:   "[javascript:alert(1)]",
+			html: "[javascript:alert(1)]",
+		},
+	}
+
+	for _, tt := range tests {
+		if got := mdSpan(tt.span, atts); got != tt.md {
+			t.Errorf("%s: mdSpan = %q, want %q", tt.name, got, tt.md)
+		}
+		if got := htmlSpan(tt.span, atts); got != tt.html {
+			t.Errorf("%s: htmlSpan = %q, want %q", tt.name, got, tt.html)
+		}
+	}
+}
+
+// noteRun encodes an attribute run of a note, as found in field 5 of the document.
+func noteRun(length int, fields ...[]byte) []byte {
+	return protoBytes(5, append([][]byte{protoVarint(1, uint64(length))}, fields...)...)
+}
+
+// noteData encodes the text and attribute runs of a note, as stored in ZDATA.
+func noteData(text string, runs ...[]byte) []byte {
+	doc := append([][]byte{protoString(2, text)}, runs...)
+	return protoBytes(2, protoBytes(3, doc...))
+}
+
+func TestDecodeNote(t *testing.T) {
+	style := func(fields ...[]byte) []byte { return protoBytes(2, fields...) }
+	checked := protoBytes(5, protoVarint(2, 1))
+
+	var zipped bytes.Buffer
+	z := gzip.NewWriter(&zipped)
+	z.Write(noteData("Title\nBody", noteRun(6, style(protoVarint(1, styleTitle))), noteRun(4)))
+	z.Close()
+
+	tests := []struct {
+		name string
+		data []byte
+		want []noteLine
+	}{
+		{
+			name: "empty",
+			data: nil,
+			want: nil,
+		},
+		{
+			name: "gzipped",
+			data: zipped.Bytes(),
+			want: []noteLine{
+				{style: styleTitle, spans: []noteSpan{{text: "Title"}}},
+				{style: styleBody, spans: []noteSpan{{text: "Body"}}},
+			},
+		},
+		{
+			name: "formatting",
+			data: noteData("plain bold link",
+				noteRun(6), noteRun(5, protoVarint(5, weightBoldItalic), protoVarint(6, 1), protoVarint(7, 1)),
+				noteRun(4, protoString(9, "https://example.com"))),
+			want: []noteLine{{style: styleBody, spans: []noteSpan{
+				{text: "plain "},
+				{text: "bold ", bold: true, italic: true, underline: true, strike: true},
+				{text: "link", link: "https://example.com"},
+			}}},
+		},
+		{
+			name: "checklist",
+			data: noteData("done\ntodo\n",
+				noteRun(5, style(protoVarint(1, styleChecklist), protoVarint(4, 1), checked)),
+				noteRun(5, style(protoVarint(1, styleChecklist)))),
+			want: []noteLine{
+				{style: styleChecklist, indent: 1, checked: true, spans: []noteSpan{{text: "done"}}},
+				{style: styleChecklist, spans: []noteSpan{{text: "todo"}}},
+			},
+		},
+		{
+			// Runs are measured in UTF-16, so the emoji counts as two
+			name: "utf-16",
+			data: noteData("a\U0001f600b c", noteRun(3, protoVarint(5, weightBold)), noteRun(3)),
+			want: []noteLine{{style: styleBody, spans: []noteSpan{{text: "a\U0001f600", bold: true}, {text: "b c"}}}},
+		},
+		{
+			name: "attachment",
+			data: noteData("see \ufffc", noteRun(4), noteRun(1, protoBytes(12, protoString(1, "ATT-1")))),
+			want: []noteLine{{style: styleBody, spans: []noteSpan{{text: "see "}, {text: "\ufffc", attachment: "ATT-1"}}}},
+		},
+		{
+			name: "text after runs",
+			data: noteData("short\nrest", noteRun(2, protoVarint(5, weightItalic))),
+			want: []noteLine{
+				{style: styleBody, spans: []noteSpan{{text: "sh", italic: true}, {text: "ort"}}},
+				{style: styleBody, spans: []noteSpan{{text: "rest"}}},
+			},
+		},
+		{
+			name: "runs after text",
+			data: noteData("ab", noteRun(5, protoVarint(5, weightBold)), noteRun(3)),
+			want: []noteLine{{style: styleBody, spans: []noteSpan{{text: "ab", bold: true}}}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := decodeNote(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	for _, data := range [][]byte{{0x1f, 0x8b, 0}, {0x12, 5}} {
+		if _, err := decodeNote(data); err == nil {
+			t.Errorf("decodeNote(%q) succeeded", data)
+		}
+	}
+}
+
+func TestNoteMarkdown(t *testing.T) {
+	n := &noteInfo{title: "Test", attachments: map[string]*noteAttachment{
+		"img": {file: "My Photo.jpg"},
+	}}
+	line := func(style int, text string) noteLine {
+		return noteLine{style: style, spans: []noteSpan{{text: text}}}
+	}
+
+	tests := []struct {
+		name  string
+		lines []noteLine
+		want  string
+	}{
+		{
+			name:  "paragraphs",
+			lines: []noteLine{line(styleTitle, "Title"), line(styleBody, ""), line(styleBody, "Body")},
+			want:  "# Title\n\nBody\n",
+		},
+		{
+			name: "lists",
+			lines: []noteLine{
+				line(styleDotted, "one"),
+				{style: styleNumbered, indent: 1, spans: []noteSpan{{text: "two"}}},
+				{style: styleChecklist, checked: true, spans: []noteSpan{{text: "three"}}},
+				line(styleBody, "after"),
+			},
+			want: "- one\n  1. two\n- [x] three\n\nafter\n",
+		},
+		{
+			name:  "code",
+			lines: []noteLine{line(styleBody, "before"), line(styleMonospace, "a **b**"), line(styleMonospace, "c")},
+			want:  "before\n\n```\na **b**\nc\n```\n",
+		},
+		{
+			name: "spans",
+			lines: []noteLine{{style: styleHeading, spans: []noteSpan{
+				{text: " bold ", bold: true}, {text: "gone", strike: true}, {text: " "}, {attachment: "img"}, {attachment: "missing"},
+			}}},
+			want: "##  **bold** ~~gone~~ ![My Photo.jpg](Attachments/My%20Photo.jpg)[Attachment]\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := noteMarkdown(n, tt.lines); got != tt.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tt.name, got, tt.want)
+		}
+	}
+}
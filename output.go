@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Output formats for the listing commands, selected with --format.
+const (
+	formatText   = "text"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+)
+
+func validFormat(f string) bool {
+	switch f {
+	case formatText, formatJSON, formatNDJSON, formatCSV:
+		return true
+	}
+	return false
+}
+
+// record is a single item of machine readable output.
+type record interface {
+	csvHeader() []string
+	csvRow() []string
+}
+
+// DomainRecord summarises a domain of the backup.
+type DomainRecord struct {
+	Domain string `json:"domain"`
+	Files  int    `json:"files"`
+	Bytes  int64  `json:"bytes"`
+}
+
+func (r *DomainRecord) csvHeader() []string {
+	return []string{"domain", "files", "bytes"}
+}
+
+func (r *DomainRecord) csvRow() []string {
+	return []string{r.Domain, strconv.Itoa(r.Files), strconv.FormatInt(r.Bytes, 10)}
+}
+
+// FileRecord describes a single entry of the tree.
+type FileRecord struct {
+	Path   string     `json:"path"`
+	Type   string     `json:"type"`
+	Domain string     `json:"domain"`
+	FileID string     `json:"fileID,omitempty"`
+	Size   int64      `json:"size"`
+	Mtime  *time.Time `json:"mtime,omitempty"`
+	Mode   string     `json:"mode"`
+}
+
+func (r *FileRecord) csvHeader() []string {
+	return []string{"path", "type", "domain", "fileID", "size", "mtime", "mode"}
+}
+
+func (r *FileRecord) csvRow() []string {
+	mtime := ""
+	if r.Mtime != nil {
+		mtime = r.Mtime.Format(time.RFC3339)
+	}
+	return []string{r.Path, r.Type, r.Domain, r.FileID, strconv.FormatInt(r.Size, 10), mtime, r.Mode}
+}
+
+// newFileRecord builds the record for entry e found at path p.
+func newFileRecord(p string, e NodeEntry) (*FileRecord, error) {
+	if _, ok := e.(*DirNode); ok {
+		return &FileRecord{Path: p, Type: "directory", Domain: e.Domain(), Mode: "drwxr-xr-x"}, nil
+	}
+
+	if v, ok := e.(*VirtualNode); ok {
+		info, err := v.Stat()
+		if err != nil {
+			return nil, err
+		}
+		mtime := info.ModTime()
+		return &FileRecord{Path: p, Type: "generated", Domain: v.Domain(), Size: info.Size(), Mtime: &mtime, Mode: info.Mode().String()}, nil
+	}
+
+	m, err := global.db.GetFile(e.ID())
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := e.(*FileNode); ok && !f.mtime.IsZero() {
+		m.File.LastModified = f.mtime
+	}
+	return &FileRecord{
+		Path:   p,
+		Type:   "file",
+		Domain: m.Domain,
+		FileID: m.ID,
+		Size:   m.File.Size,
+		Mtime:  &m.File.LastModified,
+		Mode:   m.File.FileMode().String(),
+	}, nil
+}
+
+// recordWriter writes records in one of the machine readable formats.  JSON output is
+// collected and written as a single array by Close(), the other formats are streamed.
+type recordWriter struct {
+	format  string
+	w       io.Writer
+	csv     *csv.Writer
+	records []record
+}
+
+func newRecordWriter(w io.Writer, format string) *recordWriter {
+	rw := &recordWriter{format: format, w: w}
+	if format == formatCSV {
+		rw.csv = csv.NewWriter(w)
+	}
+	return rw
+}
+
+func (rw *recordWriter) Write(r record) error {
+	switch rw.format {
+	case formatJSON:
+		rw.records = append(rw.records, r)
+	case formatNDJSON:
+		return json.NewEncoder(rw.w).Encode(r)
+	case formatCSV:
+		if rw.records == nil {
+			rw.records = []record{}
+			if err := rw.csv.Write(r.csvHeader()); err != nil {
+				return err
+			}
+		}
+		return rw.csv.Write(r.csvRow())
+	default:
+		return fmt.Errorf("unsupported output format: %s", rw.format)
+	}
+	return nil
+}
+
+func (rw *recordWriter) Close() error {
+	switch rw.format {
+	case formatJSON:
+		if rw.records == nil {
+			rw.records = []record{}
+		}
+		enc := json.NewEncoder(rw.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rw.records)
+	case formatCSV:
+		rw.csv.Flush()
+		return rw.csv.Error()
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordWriter(t *testing.T) {
+	mtime := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+	records := []record{
+		&FileRecord{Path: "Media", Type: "directory", Domain: "CameraRollDomain", Mode: "drwxr-xr-x"},
+		&FileRecord{Path: "Media/a,b.jpg", Type: "file", Domain: "CameraRollDomain", FileID: "ab12", Size: 7,
+			Mtime: &mtime, Mode: "-rw-r--r--"},
+	}
+
+	tests := []struct {
+		format  string
+		records []record
+		want    string
+	}{
+		{
+			format:  formatJSON,
+			records: records,
+			want: `[
+  {
+    "path": "Media",
+    "type": "directory",
+    "domain": "CameraRollDomain",
+    "size": 0,
+    "mode": "drwxr-xr-x"
+  },
+  {
+    "path": "Media/a,b.jpg",
+    "type": "file",
+    "domain": "CameraRollDomain",
+    "fileID": "ab12",
+    "size": 7,
+    "mtime": "2020-09-13T12:26:40Z",
+    "mode": "-rw-r--r--"
+  }
+]
+`,
+		},
+		{
+			format:  formatJSON,
+			records: nil,
+			want:    "[]\n",
+		},
+		{
+			format:  formatNDJSON,
+			records: records,
+			want: `{"path":"Media","type":"directory","domain":"CameraRollDomain","size":0,"mode":"drwxr-xr-x"}
+{"path":"Media/a,b.jpg","type":"file","domain":"CameraRollDomain","fileID":"ab12","size":7,"mtime":"2020-09-13T12:26:40Z","mode":"-rw-r--r--"}
+`,
+		},
+		{
+			format:  formatCSV,
+			records: records,
+			want: `path,type,domain,fileID,size,mtime,mode
+Media,directory,CameraRollDomain,,0,,drwxr-xr-x
+"Media/a,b.jpg",file,CameraRollDomain,ab12,7,2020-09-13T12:26:40Z,-rw-r--r--
+`,
+		},
+		{
+			format:  formatCSV,
+			records: []record{&DomainRecord{Domain: "HomeDomain", Files: 3, Bytes: 4096}},
+			want:    "domain,files,bytes\nHomeDomain,3,4096\n",
+		},
+		{
+			format:  formatCSV,
+			records: nil,
+			want:    "",
+		},
+	}
+
+	for _, tt := range tests {
+		var b strings.Builder
+		rw := newRecordWriter(&b, tt.format)
+		for _, r := range tt.records {
+			if err := rw.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.format, b.String(), tt.want)
+		}
+	}
+
+	if err := newRecordWriter(&strings.Builder{}, formatText).Write(records[0]); err == nil {
+		t.Error("text records were written")
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// The overlay holds files written through the mount (-overlay), so the backup itself is never
+// modified.  A file from the backup is copied to the overlay the first time it is written
+// ("copied up"), after which the copy is used in its place.  Created files only ever exist
+// in the overlay, while deletes and renames only change the tree.  Everything is discarded
+// when the filesystem is unmounted.
+
+var errReadOnly = errors.New("read-only file system (see -overlay)")
+
+// overlayDir returns the private directory holding this mount's overlay files.
+func overlayDir() (string, error) {
+	if global.Overlay == "" {
+		return "", errReadOnly
+	}
+
+	if global.overlayDir == "" {
+		if err := os.MkdirAll(global.Overlay, 0700); err != nil {
+			return "", err
+		}
+		dir, err := os.MkdirTemp(global.Overlay, "overlay-")
+		if err != nil {
+			return "", err
+		}
+		debug("Using overlay directory %s", dir)
+		global.overlayDir = dir
+	}
+	return global.overlayDir, nil
+}
+
+// overlayFile returns the name of the overlay file for inode.
+func overlayFile(inode uint64) (string, error) {
+	dir, err := overlayDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, fmt.Sprintf("%d", inode)), nil
+}
+
+// CopyUp copies the file to the overlay, if not already there, so it can be modified.
+func (f *FileNode) CopyUp() error {
+	debug("FileNode:CopyUp Called")
+	if f.overlay != "" {
+		return nil
+	}
+
+	name, err := overlayFile(f.inode)
+	if err != nil {
+		return err
+	}
+
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(name)
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(name)
+		return err
+	}
+
+	f.overlay = name
+	return nil
+}
+
+// OpenWrite opens the file for reading and writing, copying it up first.
+func (f *FileNode) OpenWrite() (*os.File, error) {
+	debug("FileNode:OpenWrite Called")
+	if err := f.CopyUp(); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(f.overlay, os.O_RDWR, 0)
+}
+
+// Discard removes the overlay copy of the file, once it is no longer part of the tree.
+func (f *FileNode) Discard() {
+	debug("FileNode:Discard Called")
+	if f.overlay != "" {
+		os.Remove(f.overlay)
+	}
+}
+
+// CreateFile adds a new, empty file to the directory, which only exists in the overlay.
+func (d *DirNode) CreateFile(name string) (*FileNode, error) {
+	debug("DirNode:CreateFile Called: %s", name)
+	if _, ok := d.entries[name]; ok {
+		return nil, os.ErrExist
+	}
+
+	inode := nextID()
+	file, err := overlayFile(inode)
+	if err != nil {
+		return nil, err
+	}
+	fh, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fh.Close()
+
+	f := &FileNode{
+		inode:   inode,
+		name:    name,
+		domain:  d.domain,
+		overlay: file,
+	}
+	d.Insert(name, f)
+	return f, nil
+}
+
+// Insert adds (or replaces) a directory entry.
+func (d *DirNode) Insert(name string, e NodeEntry) {
+	if old, ok := d.entries[name].(*FileNode); ok {
+		old.links--
+	}
+	if f, ok := e.(*FileNode); ok {
+		f.links++
+	}
+	d.entries[name] = e
+	if b := d.base(); b.folded != nil {
+		b.refold()
+	}
+}
+
+// Remove removes a directory entry.
+func (d *DirNode) Remove(name string) {
+	if f, ok := d.entries[name].(*FileNode); ok {
+		f.links--
+	}
+	delete(d.entries, name)
+	if b := d.base(); b.folded != nil {
+		b.refold()
+	}
+}
+
+// Rename changes the name of the entry.
+func (f *FileNode) Rename(name string) {
+	f.name = name
+	f.orig = name
+}
+
+// Rename changes the name of the entry.
+func (d *DirNode) Rename(name string) {
+	d.name = name
+	d.orig = name
+}
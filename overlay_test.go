@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestLinks(t *testing.T) {
+	a := &FileNode{inode: nextID(), name: "a"}
+	b := &FileNode{inode: nextID(), name: "b"}
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	alias := d.Alias("alias")
+
+	tests := []struct {
+		op     string
+		dir    *DirNode
+		name   string
+		file   *FileNode
+		linksA int
+		linksB int
+	}{
+		{"insert", d, "a", a, 1, 0},
+		{"insert", d, "copy", a, 2, 0},
+		{"insert", alias, "b", b, 2, 1},
+		{"insert", d, "copy", b, 1, 2},
+		{"remove", alias, "a", nil, 0, 2},
+		{"remove", d, "missing", nil, 0, 2},
+		{"insert", d, "copy", b, 0, 2},
+		{"insert", d, "dir", nil, 0, 2},
+		{"insert", d, "b", a, 1, 1},
+		{"remove", d, "copy", nil, 1, 0},
+	}
+	for i, tt := range tests {
+		switch tt.op {
+		case "insert":
+			if tt.file != nil {
+				tt.dir.Insert(tt.name, tt.file)
+			} else {
+				tt.dir.Insert(tt.name, &DirNode{inode: nextID(), name: tt.name, entries: make(map[string]NodeEntry)})
+			}
+		case "remove":
+			tt.dir.Remove(tt.name)
+		}
+		if a.links != tt.linksA || b.links != tt.linksB {
+			t.Errorf("%d: %s %q: links = %d, %d, want %d, %d", i, tt.op, tt.name, a.links, b.links, tt.linksA, tt.linksB)
+		}
+	}
+}
+
+func TestInsertIgnoreCase(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+	global.IgnoreCase = true
+
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	alias := d.Alias("alias")
+	d.foldNames()
+
+	tests := []struct {
+		op     string
+		dir    *DirNode
+		name   string
+		lookup string
+		want   string
+	}{
+		{"insert", d, "Notes.txt", "notes.TXT", "Notes.txt"},
+		{"insert", alias, "notes.txt", "NOTES.TXT", "Notes.txt"},
+		{"remove", d, "Notes.txt", "NOTES.TXT", "notes.txt"},
+		{"remove", alias, "notes.txt", "Notes.txt", ""},
+	}
+	for _, tt := range tests {
+		switch tt.op {
+		case "insert":
+			tt.dir.Insert(tt.name, &FileNode{inode: nextID(), name: tt.name})
+		case "remove":
+			tt.dir.Remove(tt.name)
+		}
+		for _, dir := range []*DirNode{d, alias} {
+			got := ""
+			if e := dir.Lookup(tt.lookup); e != nil {
+				got = e.Name()
+			}
+			if got != tt.want {
+				t.Errorf("%s %q: Lookup(%q) in %s = %q, want %q", tt.op, tt.name, tt.lookup, dir.name, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestCreateFile(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	global.Overlay = ""
+	global.overlayDir = ""
+	if _, err := d.CreateFile("new.txt"); err != errReadOnly {
+		t.Fatalf("CreateFile without -overlay: got %v, want %v", err, errReadOnly)
+	}
+
+	global.Overlay = t.TempDir()
+	f, err := d.CreateFile("new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Lookup("new.txt") != f || f.links != 1 {
+		t.Errorf("created file not in directory, links = %d", f.links)
+	}
+	if _, err := d.CreateFile("new.txt"); !errors.Is(err, os.ErrExist) {
+		t.Errorf("CreateFile of an existing name: got %v, want %v", err, os.ErrExist)
+	}
+
+	w, err := f.OpenWrite()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString("hello"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if data, err := os.ReadFile(f.overlay); err != nil || string(data) != "hello" {
+		t.Errorf("overlay holds %q, %v", data, err)
+	}
+
+	d.Remove("new.txt")
+	f.Discard()
+	if _, err := os.Stat(f.overlay); !os.IsNotExist(err) {
+		t.Errorf("overlay file not removed: %v", err)
+	}
+}
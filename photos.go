@@ -0,0 +1,398 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Top level directory presenting the photo library the way the Photos app does.
+const photosDir = "Photos"
+
+// Location of the photo library in the backup.  Asset directories are relative to Media/.
+const (
+	photosDomain = "CameraRollDomain"
+	photosPath   = "Media/PhotoData/Photos.sqlite"
+)
+
+// Asset kinds and subtypes, and the kind of albums created by the user.
+const (
+	photoKindVideo         = 1
+	photoSubtypeLive       = 2
+	photoSubtypeScreenshot = 10
+	photoAlbumUser         = 2
+)
+
+// The latitude and longitude of assets without a location.
+const noLocation = -180
+
+// Which files to present for edited photos and videos, selected with -edits.
+const (
+	editsOriginals = "originals"
+	editsLatest    = "latest"
+	editsBoth      = "both"
+)
+
+// Directories within Photos/.
+const (
+	photosByDate     = "by-date"
+	photosAlbums     = "albums"
+	photosAssets     = "assets"
+	photosFavorites  = "favorites"
+	photosHidden     = "hidden"
+	photosDeleted    = "recently-deleted"
+	photosVideos     = "videos"
+	photosScreenshot = "screenshots"
+	photosLive       = "live-photos"
+)
+
+// photoAsset is a photo or video in the library.
+type photoAsset struct {
+	id       int64
+	uuid     string
+	dir      string
+	filename string
+	date     time.Time // in the time zone where taken if known, otherwise UTC
+	kind     int
+	subtype  int
+	favorite bool
+	hidden   bool
+	trashed  bool
+	lat, lon float64
+}
+
+// stem returns the file name of the asset without its extension (eg: IMG_0001).
+func (a *photoAsset) stem() string {
+	return strings.TrimSuffix(a.filename, path.Ext(a.filename))
+}
+
+// path returns the path of the asset in the camera roll domain.
+func (a *photoAsset) path() string {
+	return "Media/" + a.dir + "/" + a.filename
+}
+
+// addPhotosView adds Photos/ presenting the camera roll by date, album and type of media.
+// Every entry is the file in the backup, so nothing is copied.
+func addPhotosView(root *DirNode) error {
+	addViewDir(root, photosDir, func(d *DirNode) error {
+		return populatePhotos(root, d)
+	})
+	return nil
+}
+
+func populatePhotos(root, d *DirNode) error {
+	file, err := backupDB(root, photosDomain, photosPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	assets, err := readAssets(db)
+	if err != nil {
+		return err
+	}
+	albums, err := readAlbums(db)
+	if err != nil {
+		debug("Photo albums: %v", err)
+	}
+
+	files, err := cameraFiles()
+	if err != nil {
+		return err
+	}
+	var meta map[int64]*photoMeta
+	if global.XMP {
+		meta = readPhotoMeta(db)
+	}
+
+	dirs := make(map[string]*DirNode)
+	for _, name := range []string{photosByDate, photosAlbums, photosAssets, photosFavorites, photosHidden,
+		photosDeleted, photosVideos, photosScreenshot, photosLive} {
+		dirs[name] = d.Subdir(name, photosDomain)
+	}
+
+	for _, a := range assets {
+		parts, err := findParts(root, a, files)
+		if err != nil {
+			// Assets kept only in iCloud are not in the backup
+			debug("Photo %s: %v", a.path(), err)
+			continue
+		}
+		entries := parts.entries(a, global.Edits)
+		add := func(dir *DirNode) {
+			for _, e := range entries {
+				name := uniqueName(dir, e.name)
+				dir.entries[name] = e.f.withTime(name, e.date)
+				if global.XMP {
+					addSidecar(dir, name, a, meta[a.id])
+				}
+			}
+		}
+
+		// Like the Photos app, hidden and deleted assets only appear in their own albums
+		switch {
+		case a.trashed:
+			add(dirs[photosDeleted])
+			continue
+		case a.hidden:
+			add(dirs[photosHidden])
+			continue
+		}
+
+		add(dirs[photosByDate].Subdir(fmt.Sprint(a.date.Year()), photosDomain).
+			Subdir(fmt.Sprintf("%02d", a.date.Month()), photosDomain))
+		if a.favorite {
+			add(dirs[photosFavorites])
+		}
+		switch {
+		case a.kind == photoKindVideo:
+			add(dirs[photosVideos])
+		case a.subtype == photoSubtypeScreenshot:
+			add(dirs[photosScreenshot])
+		case a.subtype == photoSubtypeLive:
+			add(dirs[photosLive])
+		}
+		for _, album := range albums[a.id] {
+			add(dirs[photosAlbums].Subdir(album, photosDomain))
+		}
+
+		group := dirs[photosAssets].Subdir(uniqueName(dirs[photosAssets], mapName(a.stem())), photosDomain)
+		for _, e := range parts.group(a) {
+			group.entries[uniqueName(group, e.f.name)] = e.f.withTime(e.f.name, e.date)
+		}
+		if global.XMP {
+			addSidecar(group, parts.original.name, a, meta[a.id])
+		}
+	}
+	return nil
+}
+
+// photoParts are the files making up an asset: the original, the video of a Live Photo, and
+// the rendered edits and adjustments made in the Photos app, if any.
+type photoParts struct {
+	original, video     *FileNode
+	render, renderVideo *FileNode
+	adjustments         *FileNode
+}
+
+// photoEntry is a file to present for an asset, with the time to show for it.  Edits keep
+// the time they were made.
+type photoEntry struct {
+	name string
+	f    *FileNode
+	date time.Time
+}
+
+// cameraFiles returns the paths of the files in the camera roll, keyed by their path without
+// extension in lower case, for finding the files belonging with an asset.
+func cameraFiles() (map[string][]string, error) {
+	list, err := global.db.FindFiles(photosDomain, "Media/%")
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]string)
+	for _, p := range list {
+		key := strings.ToLower(strings.TrimSuffix(p, path.Ext(p)))
+		files[key] = append(files[key], p)
+	}
+	return files, nil
+}
+
+// findParts finds the files of an asset.  Edits are kept in PhotoData/Mutations, in a
+// directory named after the original (eg: Mutations/DCIM/100APPLE/IMG_0001/Adjustments), as
+// FullSizeRender.jpg (or .heic), FullSizeRender.mov and Adjustments.plist.
+func findParts(root *DirNode, a *photoAsset, files map[string][]string) (*photoParts, error) {
+	original, err := backupFile(root, photosDomain, a.path())
+	if err != nil {
+		return nil, err
+	}
+	parts := &photoParts{original: original}
+
+	file := func(key string, video bool) *FileNode {
+		for _, p := range files[strings.ToLower(key)] {
+			if p == a.path() || strings.EqualFold(path.Ext(p), ".mov") != video {
+				continue
+			}
+			if f, err := backupFile(root, photosDomain, p); err == nil {
+				return f
+			}
+		}
+		return nil
+	}
+
+	edits := "Media/PhotoData/Mutations/" + a.dir + "/" + a.stem() + "/Adjustments/"
+	if a.kind == photoKindVideo {
+		parts.render = file(edits+"FullSizeRender", true)
+	} else {
+		parts.video = file("Media/"+a.dir+"/"+a.stem(), true)
+		parts.render = file(edits+"FullSizeRender", false)
+		parts.renderVideo = file(edits+"FullSizeRender", true)
+	}
+	parts.adjustments = file(edits+"Adjustments", false)
+	return parts, nil
+}
+
+// entries returns the files to present for the asset with -edits: the originals, the latest
+// edits (named like the original, or the originals where not edited), or both (with the
+// edits named "<name> (edited)").
+func (p *photoParts) entries(a *photoAsset, edits string) []photoEntry {
+	var list []photoEntry
+	add := func(name string, f *FileNode, date time.Time) {
+		if f != nil {
+			list = append(list, photoEntry{name, f, date})
+		}
+	}
+	edited := func(f *FileNode, suffix string) string {
+		return mapName(a.stem() + suffix + path.Ext(f.Original()))
+	}
+
+	if edits == editsLatest && p.render != nil {
+		add(edited(p.render, ""), p.render, time.Time{})
+	} else {
+		add(p.original.name, p.original, a.date)
+	}
+	if edits == editsLatest && p.renderVideo != nil {
+		add(edited(p.renderVideo, ""), p.renderVideo, time.Time{})
+	} else if p.video != nil {
+		add(p.video.name, p.video, a.date)
+	}
+	if edits == editsBoth {
+		if p.render != nil {
+			add(edited(p.render, " (edited)"), p.render, time.Time{})
+		}
+		if p.renderVideo != nil {
+			add(edited(p.renderVideo, " (edited)"), p.renderVideo, time.Time{})
+		}
+	}
+	return list
+}
+
+// group returns every file of the asset, with their own names, for Photos/assets.
+func (p *photoParts) group(a *photoAsset) []photoEntry {
+	var list []photoEntry
+	for _, e := range []photoEntry{{f: p.original, date: a.date}, {f: p.video, date: a.date},
+		{f: p.render}, {f: p.renderVideo}, {f: p.adjustments}} {
+		if e.f != nil {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// assetTable returns the table holding assets, which was renamed in iOS 14.
+func assetTable(db *sql.DB) string {
+	if hasColumn(db, "ZASSET", "ZFILENAME") {
+		return "ZASSET"
+	}
+	return "ZGENERICASSET"
+}
+
+// readAssets reads every asset in the library, oldest first.
+func readAssets(db *sql.DB) ([]*photoAsset, error) {
+	table := assetTable(db)
+	// The offset from UTC where the photo was taken, from iOS 13
+	offset := "null"
+	if hasColumn(db, "ZADDITIONALASSETATTRIBUTES", "ZTIMEZONEOFFSET") {
+		offset = `(select ZTIMEZONEOFFSET from ZADDITIONALASSETATTRIBUTES z where z.ZASSET = ` + table + `.Z_PK)`
+	}
+
+	r, err := db.Query(`select Z_PK, coalesce(ZUUID,''), ZDIRECTORY, ZFILENAME, coalesce(ZDATECREATED,0),
+		coalesce(ZKIND,0), ` + columnOr(db, table, "ZKINDSUBTYPE", "0") + `, coalesce(ZFAVORITE,0),
+		coalesce(ZHIDDEN,0), ` + columnOr(db, table, "ZTRASHEDSTATE", "0") + `, ` + columnOr(db, table, "ZLATITUDE", fmt.Sprint(noLocation)) + `,
+		` + columnOr(db, table, "ZLONGITUDE", fmt.Sprint(noLocation)) + `, ` + offset + ` from ` + table + `
+		where ZDIRECTORY is not null and ZFILENAME is not null order by ZDATECREATED, Z_PK`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var assets []*photoAsset
+	for r.Next() {
+		a := &photoAsset{}
+		var date float64
+		var offset sql.NullInt64
+		if err := r.Scan(&a.id, &a.uuid, &a.dir, &a.filename, &date, &a.kind, &a.subtype, &a.favorite,
+			&a.hidden, &a.trashed, &a.lat, &a.lon, &offset); err != nil {
+			return nil, err
+		}
+		a.date = appleTime(date).UTC()
+		if offset.Valid {
+			a.date = a.date.In(time.FixedZone("", int(offset.Int64)))
+		}
+		assets = append(assets, a)
+	}
+	return assets, r.Err()
+}
+
+// joinTable finds the table joining two entities in a many-to-many relationship, with its
+// columns.  These are named after entity numbers which vary between versions of iOS (eg:
+// Z_26ASSETS with columns Z_26ALBUMS and Z_3ASSETS), so it is found by its columns.
+func joinTable(db *sql.DB, from, to string) (table, fromCol, toCol string, err error) {
+	err = db.QueryRow(`select m.name, a.name, b.name from sqlite_master m
+		join pragma_table_info(m.name) a on a.name like ? escape '\'
+		join pragma_table_info(m.name) b on b.name like ? escape '\' and b.name not like 'Z\_FOK\_%' escape '\'
+		where m.type = 'table' and m.name like ? escape '\'`,
+		`Z\_%`+from, `Z\_%`+to, `Z\_%`+to).Scan(&table, &fromCol, &toCol)
+	return
+}
+
+// readAlbums returns the directory names of the user's albums holding each asset.  Albums
+// sharing a title (once mapped) are told apart by their primary key.
+func readAlbums(db *sql.DB) (map[int64][]string, error) {
+	join, albumCol, assetCol, err := joinTable(db, "ALBUMS", "ASSETS")
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := db.Query(`select Z_PK, ZTITLE from ZGENERICALBUM
+		where ZKIND = ? and ZTITLE is not null and `+columnOr(db, "ZGENERICALBUM", "ZTRASHEDSTATE", "0")+` = 0`,
+		photoAlbumUser)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	names := make(map[int64]string)
+	count := make(map[string]int)
+	for r.Next() {
+		var pk int64
+		var title string
+		if err := r.Scan(&pk, &title); err != nil {
+			return nil, err
+		}
+		names[pk] = safeName(title)
+		count[names[pk]]++
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+	for pk, name := range names {
+		if count[name] > 1 {
+			names[pk] = fmt.Sprintf("%s (%d)", name, pk)
+		}
+	}
+
+	r, err = db.Query(`select ` + quoteIdent(albumCol) + `, ` + quoteIdent(assetCol) + ` from ` + quoteIdent(join))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	albums := make(map[int64][]string)
+	for r.Next() {
+		var album, id int64
+		if err := r.Scan(&album, &id); err != nil {
+			return nil, err
+		}
+		if name, ok := names[album]; ok {
+			albums[id] = append(albums[id], name)
+		}
+	}
+	return albums, r.Err()
+}
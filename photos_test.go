@@ -0,0 +1,243 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAssetNames(t *testing.T) {
+	tests := []struct {
+		dir, filename string
+		stem, path    string
+	}{
+		{"DCIM/100APPLE", "IMG_0001.JPG", "IMG_0001", "Media/DCIM/100APPLE/IMG_0001.JPG"},
+		{"DCIM/100APPLE", "IMG_0002.live.MOV", "IMG_0002.live", "Media/DCIM/100APPLE/IMG_0002.live.MOV"},
+		{"DCIM/101APPLE", "noext", "noext", "Media/DCIM/101APPLE/noext"},
+	}
+	for _, tt := range tests {
+		a := &photoAsset{dir: tt.dir, filename: tt.filename}
+		if got := a.stem(); got != tt.stem {
+			t.Errorf("stem(%q) = %q, want %q", tt.filename, got, tt.stem)
+		}
+		if got := a.path(); got != tt.path {
+			t.Errorf("path(%q) = %q, want %q", tt.filename, got, tt.path)
+		}
+	}
+}
+
+func TestReadAssets(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema []string
+		want   []*photoAsset
+	}{
+		{
+			name: "current",
+			schema: []string{
+				`create table ZASSET (Z_PK integer primary key, ZUUID text, ZDIRECTORY text, ZFILENAME text,
+					ZDATECREATED real, ZKIND integer, ZKINDSUBTYPE integer, ZFAVORITE integer, ZHIDDEN integer,
+					ZTRASHEDSTATE integer, ZLATITUDE real, ZLONGITUDE real)`,
+				"create table ZADDITIONALASSETATTRIBUTES (Z_PK integer primary key, ZASSET integer, ZTIMEZONEOFFSET integer)",
+				`insert into ZASSET values (1, 'u1', 'DCIM/100APPLE', 'IMG_0002.HEIC', 600000000, 0, 2, 1, 0, 0, 51.5, -0.1)`,
+				`insert into ZASSET values (2, 'u2', 'DCIM/100APPLE', 'IMG_0001.MOV', 500000000, 1, 0, 0, 1, 1, null, null)`,
+				`insert into ZASSET values (3, 'u3', null, 'IMG_0003.JPG', 0, 0, 0, 0, 0, 0, 0, 0)`,
+				"insert into ZADDITIONALASSETATTRIBUTES values (1, 1, 32400)",
+			},
+			want: []*photoAsset{
+				{id: 2, uuid: "u2", dir: "DCIM/100APPLE", filename: "IMG_0001.MOV", date: appleTime(500000000).UTC(),
+					kind: photoKindVideo, hidden: true, trashed: true, lat: noLocation, lon: noLocation},
+				{id: 1, uuid: "u1", dir: "DCIM/100APPLE", filename: "IMG_0002.HEIC",
+					date: appleTime(600000000).In(time.FixedZone("", 32400)), subtype: photoSubtypeLive,
+					favorite: true, lat: 51.5, lon: -0.1},
+			},
+		},
+		{
+			name: "before iOS 14",
+			schema: []string{
+				`create table ZGENERICASSET (Z_PK integer primary key, ZUUID text, ZDIRECTORY text, ZFILENAME text,
+					ZDATECREATED real, ZKIND integer, ZFAVORITE integer, ZHIDDEN integer)`,
+				`insert into ZGENERICASSET values (1, null, 'DCIM/100APPLE', 'IMG_0001.JPG', 600000000, 0, 0, 0)`,
+			},
+			want: []*photoAsset{
+				{id: 1, dir: "DCIM/100APPLE", filename: "IMG_0001.JPG", date: appleTime(600000000).UTC(),
+					lat: noLocation, lon: noLocation},
+			},
+		},
+	}
+	for _, tt := range tests {
+		db, err := openSQLite(testDB(t, tt.schema...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := readAssets(db)
+		db.Close()
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d assets, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, a := range got {
+			w := tt.want[i]
+			// Times are compared by instant and offset, as zones are never equal
+			_, aOff := a.date.Zone()
+			_, wOff := w.date.Zone()
+			if !a.date.Equal(w.date) || aOff != wOff {
+				t.Errorf("%s: %s: date %v, want %v", tt.name, a.filename, a.date, w.date)
+			}
+			a.date, w.date = time.Time{}, time.Time{}
+			if !reflect.DeepEqual(a, w) {
+				t.Errorf("%s: got %+v, want %+v", tt.name, a, w)
+			}
+		}
+	}
+}
+
+func TestReadAlbums(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+	global.Escape = escapeNone
+
+	file := testDB(t,
+		"create table ZGENERICALBUM (Z_PK integer primary key, ZKIND integer, ZTITLE text, ZTRASHEDSTATE integer)",
+		"create table Z_26ASSETS (Z_26ALBUMS integer, Z_3ASSETS integer, Z_FOK_3ASSETS integer)",
+		"create table Z_26KEYASSETS (Z_26ALBUMS integer, Z_3KEYASSETS integer)",
+		"insert into ZGENERICALBUM values (1, 2, 'Holiday', 0)",
+		"insert into ZGENERICALBUM values (2, 2, 'Cats', 0)",
+		"insert into ZGENERICALBUM values (5, 2, 'Cats', null)",
+		"insert into ZGENERICALBUM values (6, 2, 'Work/Home', 0)",
+		"insert into ZGENERICALBUM values (7, 2, 'Deleted', 1)",
+		"insert into ZGENERICALBUM values (8, 1000, 'Smart', 0)",
+		"insert into ZGENERICALBUM values (9, 2, null, 0)",
+		"insert into Z_26ASSETS values (1, 10, 1), (2, 10, 2), (5, 11, 1), (6, 12, 1), (7, 13, 1), (8, 13, 2), (9, 13, 3)",
+	)
+	db, err := openSQLite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	table, from, to, err := joinTable(db, "ALBUMS", "ASSETS")
+	if err != nil || table != "Z_26ASSETS" || from != "Z_26ALBUMS" || to != "Z_3ASSETS" {
+		t.Errorf("joinTable = %q, %q, %q, %v", table, from, to, err)
+	}
+
+	albums, err := readAlbums(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64][]string{
+		10: {"Holiday", "Cats (2)"},
+		11: {"Cats (5)"},
+		12: {"Work_Home"},
+	}
+	if !reflect.DeepEqual(albums, want) {
+		t.Errorf("got %q, want %q", albums, want)
+	}
+}
+
+func TestPhotoEntries(t *testing.T) {
+	saved := global
+	defer func() { global = saved }()
+	global.Escape = escapeNone
+
+	file := func(name string) *FileNode { return &FileNode{inode: nextID(), name: name, orig: name} }
+	original := file("IMG_0001.HEIC")
+	video := file("IMG_0001.MOV")
+	render := file("FullSizeRender.jpg")
+	renderVideo := file("FullSizeRender.mov")
+	adjustments := file("Adjustments.plist")
+	labels := map[*FileNode]string{original: "original", video: "video", render: "render",
+		renderVideo: "renderVideo", adjustments: "adjustments"}
+	date := time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC)
+	a := &photoAsset{filename: "IMG_0001.HEIC", date: date}
+
+	tests := []struct {
+		name  string
+		parts photoParts
+		edits map[string][]string // entries for each -edits mode, as name=part
+		group []string
+	}{
+		{
+			name:  "photo",
+			parts: photoParts{original: original},
+			edits: map[string][]string{
+				editsOriginals: {"IMG_0001.HEIC=original"},
+				editsLatest:    {"IMG_0001.HEIC=original"},
+				editsBoth:      {"IMG_0001.HEIC=original"},
+			},
+			group: []string{"original"},
+		},
+		{
+			name:  "edited photo",
+			parts: photoParts{original: original, render: render, adjustments: adjustments},
+			edits: map[string][]string{
+				editsOriginals: {"IMG_0001.HEIC=original"},
+				editsLatest:    {"IMG_0001.jpg=render"},
+				editsBoth:      {"IMG_0001.HEIC=original", "IMG_0001 (edited).jpg=render"},
+			},
+			group: []string{"original", "render", "adjustments"},
+		},
+		{
+			name:  "live photo",
+			parts: photoParts{original: original, video: video},
+			edits: map[string][]string{
+				editsOriginals: {"IMG_0001.HEIC=original", "IMG_0001.MOV=video"},
+				editsLatest:    {"IMG_0001.HEIC=original", "IMG_0001.MOV=video"},
+				editsBoth:      {"IMG_0001.HEIC=original", "IMG_0001.MOV=video"},
+			},
+			group: []string{"original", "video"},
+		},
+		{
+			name:  "edited live photo",
+			parts: photoParts{original: original, video: video, render: render, renderVideo: renderVideo, adjustments: adjustments},
+			edits: map[string][]string{
+				editsOriginals: {"IMG_0001.HEIC=original", "IMG_0001.MOV=video"},
+				editsLatest:    {"IMG_0001.jpg=render", "IMG_0001.mov=renderVideo"},
+				editsBoth: {"IMG_0001.HEIC=original", "IMG_0001.MOV=video",
+					"IMG_0001 (edited).jpg=render", "IMG_0001 (edited).mov=renderVideo"},
+			},
+			group: []string{"original", "video", "render", "renderVideo", "adjustments"},
+		},
+		{
+			name:  "live photo with only the photo edited",
+			parts: photoParts{original: original, video: video, render: render},
+			edits: map[string][]string{
+				editsOriginals: {"IMG_0001.HEIC=original", "IMG_0001.MOV=video"},
+				editsLatest:    {"IMG_0001.jpg=render", "IMG_0001.MOV=video"},
+				editsBoth:      {"IMG_0001.HEIC=original", "IMG_0001.MOV=video", "IMG_0001 (edited).jpg=render"},
+			},
+			group: []string{"original", "video", "render"},
+		},
+	}
+	for _, tt := range tests {
+		for _, mode := range []string{editsOriginals, editsLatest, editsBoth} {
+			var got []string
+			for _, e := range tt.parts.entries(a, mode) {
+				got = append(got, e.name+"="+labels[e.f])
+				// Edits keep the time they were made
+				want := time.Time{}
+				if e.f == original || e.f == video {
+					want = date
+				}
+				if !e.date.Equal(want) {
+					t.Errorf("%s (%s): %s has date %v, want %v", tt.name, mode, e.name, e.date, want)
+				}
+			}
+			if want := tt.edits[mode]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s (%s): got %q, want %q", tt.name, mode, got, want)
+			}
+		}
+
+		var group []string
+		for _, e := range tt.parts.group(a) {
+			group = append(group, labels[e.f])
+		}
+		if !reflect.DeepEqual(group, tt.group) {
+			t.Errorf("%s: group = %q, want %q", tt.name, group, tt.group)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"howett.net/plist"
+)
+
+// Apple's reference date, used by NSDate and most Core Data timestamps.
+var appleEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// appleTime converts seconds since the Apple epoch to a time.
+func appleTime(secs float64) time.Time {
+	return appleEpoch.Add(time.Duration(secs * float64(time.Second)))
+}
+
+// isArchive reports whether v (a decoded plist) was produced by NSKeyedArchiver.
+func isArchive(v any) bool {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return false
+	}
+	_, objects := m["$objects"]
+	_, top := m["$top"]
+	return objects && top && m["$archiver"] == "NSKeyedArchiver"
+}
+
+// unarchive decodes an NSKeyedArchiver plist into plain values.  Object references are
+// resolved, and the common Foundation classes are converted to their natural go types.
+// Other objects become a map of their fields, with the class name stored as "$class".
+func unarchive(data []byte) (any, error) {
+	var v any
+	if _, err := plist.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return unarchiveValue(v)
+}
+
+// unarchiveValue is unarchive() for an already decoded plist.
+func unarchiveValue(v any) (any, error) {
+	if !isArchive(v) {
+		return nil, errors.New("not an NSKeyedArchiver archive")
+	}
+	m := v.(map[string]any)
+	objects, ok := m["$objects"].([]any)
+	if !ok {
+		return nil, errors.New("archive has no objects")
+	}
+	top, ok := m["$top"].(map[string]any)
+	if !ok {
+		return nil, errors.New("archive has no top level object")
+	}
+
+	u := &unarchiver{objects: objects, busy: make(map[plist.UID]bool)}
+	if root, ok := top["root"]; ok {
+		return u.resolve(root), nil
+	}
+
+	// Not keyed by "root", so return everything at the top level
+	r := make(map[string]any)
+	for k, o := range top {
+		r[k] = u.resolve(o)
+	}
+	return r, nil
+}
+
+type unarchiver struct {
+	objects []any
+	busy    map[plist.UID]bool
+}
+
+func (u *unarchiver) resolve(v any) any {
+	switch o := v.(type) {
+	case plist.UID:
+		if uint64(o) >= uint64(len(u.objects)) || u.busy[o] {
+			// Broken or circular reference
+			return nil
+		}
+		u.busy[o] = true
+		defer delete(u.busy, o)
+		return u.resolve(u.objects[o])
+
+	case string:
+		if o == "$null" {
+			return nil
+		}
+		return o
+
+	case []any:
+		r := make([]any, len(o))
+		for i := range o {
+			r[i] = u.resolve(o[i])
+		}
+		return r
+
+	case map[string]any:
+		return u.object(o)
+	}
+	return v
+}
+
+func (u *unarchiver) className(o map[string]any) string {
+	if ref, ok := o["$class"].(plist.UID); ok && uint64(ref) < uint64(len(u.objects)) {
+		if c, ok := u.objects[ref].(map[string]any); ok {
+			if name, ok := c["$classname"].(string); ok {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+func (u *unarchiver) object(o map[string]any) any {
+	class := u.className(o)
+
+	switch class {
+	case "NSDictionary", "NSMutableDictionary":
+		keys, _ := o["NS.keys"].([]any)
+		values, _ := o["NS.objects"].([]any)
+		r := make(map[string]any, len(keys))
+		for i := range keys {
+			if i < len(values) {
+				r[fmt.Sprint(u.resolve(keys[i]))] = u.resolve(values[i])
+			}
+		}
+		return r
+
+	case "NSArray", "NSMutableArray", "NSSet", "NSMutableSet", "NSOrderedSet", "NSMutableOrderedSet":
+		values, _ := o["NS.objects"].([]any)
+		return u.resolve(values)
+
+	case "NSString", "NSMutableString":
+		return u.resolve(o["NS.string"])
+
+	case "NSData", "NSMutableData":
+		return u.resolve(o["NS.data"])
+
+	case "NSDate":
+		return appleTime(toFloat(o["NS.time"]))
+
+	case "NSURL":
+		base, _ := u.resolve(o["NS.base"]).(string)
+		rel, _ := u.resolve(o["NS.relative"]).(string)
+		return base + rel
+	}
+
+	r := make(map[string]any, len(o))
+	for k, v := range o {
+		if k != "$class" {
+			r[k] = u.resolve(v)
+		}
+	}
+	if class != "" {
+		r["$class"] = class
+	}
+	return r
+}
+
+// toInt64 converts a decoded plist number to an int64.
+func toInt64(v any) int64 {
+	switch n := v.(type) {
+	case int64:
+		return n
+	case uint64:
+		return int64(n)
+	case float64:
+		return int64(n)
+	case bool:
+		if n {
+			return 1
+		}
+	}
+	return 0
+}
+
+// toFloat converts a decoded plist number to a float64.
+func toFloat(v any) float64 {
+	switch n := v.(type) {
+	case int64:
+		return float64(n)
+	case uint64:
+		return float64(n)
+	case float64:
+		return n
+	}
+	return 0
+}
+
+// addPlistView adds "<name>.json" and "<name>.xml" next to each property list, converted
+// when first opened.  Archives, at the top level or held in data, are decoded as well.
+func addPlistView(root *DirNode) error {
+	walkFiles(root, func(dir *DirNode, name string, f *FileNode) {
+		if !strings.EqualFold(filepath.Ext(name), ".plist") {
+			return
+		}
+
+		for _, format := range []string{formatJSON, "xml"} {
+			conv, format := name+"."+format, format
+			if _, ok := dir.entries[conv]; ok {
+				debug("Plist conversion name already in use: %s", conv)
+				continue
+			}
+			dir.entries[conv] = newVirtualWriter(conv, f.domain, func(w io.Writer) error {
+				return convertPlist(f, format, w)
+			})
+		}
+	})
+	return nil
+}
+
+// convertPlist writes the property list f as JSON or XML.
+func convertPlist(f FileEntry, format string, w io.Writer) error {
+	fh, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	data, err := io.ReadAll(fh)
+	if err != nil {
+		return err
+	}
+	var v any
+	if _, err := plist.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	v = expandArchives(v)
+
+	if format == formatJSON {
+		data, err = json.MarshalIndent(jsonValue(v), "", "  ")
+	} else {
+		data, err = plist.MarshalIndent(xmlValue(v), plist.XMLFormat, "\t")
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// expandArchives replaces NSKeyedArchiver archives within v, including binary plists held in
+// data, by their decoded values.
+func expandArchives(v any) any {
+	switch o := v.(type) {
+	case []byte:
+		if !bytes.HasPrefix(o, []byte("bplist00")) {
+			return o
+		}
+		var inner any
+		if _, err := plist.Unmarshal(o, &inner); err != nil || !isArchive(inner) {
+			return o
+		}
+		return expandArchives(inner)
+
+	case map[string]any:
+		if isArchive(o) {
+			if u, err := unarchiveValue(o); err == nil {
+				return expandArchives(u)
+			}
+		}
+		for k := range o {
+			o[k] = expandArchives(o[k])
+		}
+
+	case []any:
+		for i := range o {
+			o[i] = expandArchives(o[i])
+		}
+	}
+	return v
+}
+
+// jsonValue replaces the floats JSON cannot hold (NaN and infinities) by strings.
+func jsonValue(v any) any {
+	switch o := v.(type) {
+	case float64:
+		if math.IsNaN(o) || math.IsInf(o, 0) {
+			return fmt.Sprint(o)
+		}
+	case map[string]any:
+		for k := range o {
+			o[k] = jsonValue(o[k])
+		}
+	case []any:
+		for i := range o {
+			o[i] = jsonValue(o[i])
+		}
+	}
+	return v
+}
+
+// xmlValue removes the null values left by decoding archives, which plists cannot hold.
+// Dictionary entries are dropped, while array elements become "$null" as in the archive.
+func xmlValue(v any) any {
+	switch o := v.(type) {
+	case map[string]any:
+		for k := range o {
+			if o[k] == nil {
+				delete(o, k)
+			} else {
+				o[k] = xmlValue(o[k])
+			}
+		}
+	case []any:
+		for i := range o {
+			if o[i] == nil {
+				o[i] = "$null"
+			} else {
+				o[i] = xmlValue(o[i])
+			}
+		}
+	}
+	return v
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+)
+
+// archive encodes objects and a root reference as an NSKeyedArchiver binary plist.
+func archive(t *testing.T, root any, objects ...any) []byte {
+	t.Helper()
+	data, err := plist.Marshal(map[string]any{
+		"$archiver": "NSKeyedArchiver",
+		"$version":  100000,
+		"$objects":  append([]any{"$null"}, objects...),
+		"$top":      map[string]any{"root": root},
+	}, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// class returns the class description of an archived object.
+func class(name string) map[string]any {
+	return map[string]any{"$classname": name, "$classes": []any{name, "NSObject"}}
+}
+
+func TestUnarchive(t *testing.T) {
+	tests := []struct {
+		name    string
+		root    any
+		objects []any
+		want    any
+	}{
+		{
+			name:    "string",
+			root:    plist.UID(1),
+			objects: []any{"hello"},
+			want:    "hello",
+		},
+		{
+			name:    "null",
+			root:    plist.UID(0),
+			objects: nil,
+			want:    nil,
+		},
+		{
+			name: "dictionary",
+			root: plist.UID(1),
+			objects: []any{
+				map[string]any{
+					"$class":     plist.UID(2),
+					"NS.keys":    []any{plist.UID(3)},
+					"NS.objects": []any{plist.UID(4)},
+				},
+				class("NSDictionary"),
+				"key",
+				"value",
+			},
+			want: map[string]any{"key": "value"},
+		},
+		{
+			name: "array",
+			root: plist.UID(1),
+			objects: []any{
+				map[string]any{"$class": plist.UID(2), "NS.objects": []any{plist.UID(3), plist.UID(0)}},
+				class("NSMutableArray"),
+				"one",
+			},
+			want: []any{"one", nil},
+		},
+		{
+			name: "date",
+			root: plist.UID(1),
+			objects: []any{
+				map[string]any{"$class": plist.UID(2), "NS.time": 86400.0},
+				class("NSDate"),
+			},
+			want: time.Date(2001, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "other class",
+			root: plist.UID(1),
+			objects: []any{
+				map[string]any{"$class": plist.UID(2), "title": plist.UID(3)},
+				class("Note"),
+				"text",
+			},
+			want: map[string]any{"$class": "Note", "title": "text"},
+		},
+		{
+			name:    "reference out of range",
+			root:    plist.UID(5),
+			objects: []any{"hello"},
+			want:    nil,
+		},
+		{
+			name:    "reference beyond int",
+			root:    plist.UID(math.MaxUint64),
+			objects: []any{"hello"},
+			want:    nil,
+		},
+		{
+			name: "class out of range",
+			root: plist.UID(1),
+			objects: []any{
+				map[string]any{"$class": plist.UID(math.MaxUint64), "title": plist.UID(2)},
+				"text",
+			},
+			want: map[string]any{"title": "text"},
+		},
+		{
+			name: "circular",
+			root: plist.UID(1),
+			objects: []any{
+				map[string]any{"self": plist.UID(1)},
+			},
+			want: map[string]any{"self": nil},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unarchive(archive(t, tt.root, tt.objects...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnarchiveInvalid(t *testing.T) {
+	data, err := plist.Marshal(map[string]any{"key": "value"}, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unarchive(data); err == nil {
+		t.Error("got no error for a plist which is not an archive")
+	}
+}
+
+func TestConvertPlist(t *testing.T) {
+	note := archive(t, plist.UID(1),
+		map[string]any{"$class": plist.UID(3), "title": plist.UID(2), "body": plist.UID(0)},
+		"Shopping",
+		class("Note"),
+	)
+
+	tests := []struct {
+		name   string
+		plist  any
+		format string
+		want   string
+	}{
+		{
+			name:   "plain",
+			plist:  map[string]any{"count": 2, "name": "x"},
+			format: formatJSON,
+			want: `{
+  "count": 2,
+  "name": "x"
+}
+`,
+		},
+		{
+			name:   "not a number",
+			plist:  []any{math.NaN(), math.Inf(-1), 1.5},
+			format: formatJSON,
+			want: `[
+  "NaN",
+  "-Inf",
+  1.5
+]
+`,
+		},
+		{
+			name:   "archive in data",
+			plist:  map[string]any{"note": note, "raw": []byte("bplist00")},
+			format: formatJSON,
+			want: `{
+  "note": {
+    "$class": "Note",
+    "body": null,
+    "title": "Shopping"
+  },
+  "raw": "YnBsaXN0MDA="
+}
+`,
+		},
+		{
+			name:   "archive in data",
+			plist:  map[string]any{"note": note},
+			format: "xml",
+			want: `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+	<dict>
+		<key>note</key>
+		<dict>
+			<key>$class</key>
+			<string>Note</string>
+			<key>title</key>
+			<string>Shopping</string>
+		</dict>
+	</dict>
+</plist>
+`,
+		},
+	}
+
+	dir := t.TempDir()
+	for i, tt := range tests {
+		// The binary encoder can not hold NaN, as it is not equal to itself
+		data, err := plist.Marshal(tt.plist, plist.XMLFormat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, fmt.Sprintf("%d.plist", i))
+		if err := os.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		var b strings.Builder
+		if err := convertPlist(&FileNode{name: "test.plist", overlay: file}, tt.format, &b); err != nil {
+			t.Errorf("%s (%s): %v", tt.name, tt.format, err)
+		} else if b.String() != tt.want {
+			t.Errorf("%s (%s): got\n%s\nwant\n%s", tt.name, tt.format, b.String(), tt.want)
+		}
+	}
+
+	file := filepath.Join(dir, "bad.plist")
+	if err := os.WriteFile(file, []byte("bplist00 truncated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := convertPlist(&FileNode{name: "bad.plist", overlay: file}, formatJSON, &strings.Builder{}); err == nil {
+		t.Error("converted a damaged plist")
+	}
+}
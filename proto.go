@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// A minimal protocol buffer decoder, enough for reading messages whose layout is known
+// (such as notes) without their schema or generated code.
+
+// Protocol buffer wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errProto = errors.New("invalid protocol buffer")
+
+// protoField is a field of an encoded message.  Numbers are held in value, while strings,
+// bytes and embedded messages are held in data.
+type protoField struct {
+	num   int
+	wire  int
+	value uint64
+	data  []byte
+}
+
+// protoMessage is a decoded message, with the fields in the order they were found.
+type protoMessage []protoField
+
+// parseProto decodes the fields of a message.
+func parseProto(data []byte) (protoMessage, error) {
+	var m protoMessage
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errProto
+		}
+		data = data[n:]
+
+		f := protoField{num: int(key >> 3), wire: int(key & 7)}
+		switch f.wire {
+		case wireVarint:
+			if f.value, n = binary.Uvarint(data); n <= 0 {
+				return nil, errProto
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, errProto
+			}
+			f.value, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, errProto
+			}
+			f.value, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return nil, errProto
+			}
+			f.data, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return nil, errProto
+		}
+		m = append(m, f)
+	}
+	return m, nil
+}
+
+// field returns the last occurrence of a field, which is the one used for singular fields.
+func (m protoMessage) field(num int) (protoField, bool) {
+	for i := len(m) - 1; i >= 0; i-- {
+		if m[i].num == num {
+			return m[i], true
+		}
+	}
+	return protoField{}, false
+}
+
+func (m protoMessage) has(num int) bool {
+	_, ok := m.field(num)
+	return ok
+}
+
+func (m protoMessage) uint(num int) uint64 {
+	f, _ := m.field(num)
+	return f.value
+}
+
+func (m protoMessage) string(num int) string {
+	f, _ := m.field(num)
+	return string(f.data)
+}
+
+// message returns an embedded message, or an empty one if missing or invalid.
+func (m protoMessage) message(num int) protoMessage {
+	f, _ := m.field(num)
+	sub, _ := parseProto(f.data)
+	return sub
+}
+
+// messages returns each occurrence of a repeated embedded message.
+func (m protoMessage) messages(num int) []protoMessage {
+	var list []protoMessage
+	for _, f := range m {
+		if f.num == num && f.wire == wireBytes {
+			if sub, err := parseProto(f.data); err == nil {
+				list = append(list, sub)
+			}
+		}
+	}
+	return list
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// protoVarint encodes a varint field.
+func protoVarint(num int, v uint64) []byte {
+	b := binary.AppendUvarint(nil, uint64(num)<<3|wireVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+// protoBytes encodes a length delimited field, made up of the parts.
+func protoBytes(num int, parts ...[]byte) []byte {
+	var data []byte
+	for _, p := range parts {
+		data = append(data, p...)
+	}
+	b := binary.AppendUvarint(nil, uint64(num)<<3|wireBytes)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// protoString encodes a string field.
+func protoString(num int, s string) []byte {
+	return protoBytes(num, []byte(s))
+}
+
+func TestParseProto(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want protoMessage
+	}{
+		{"empty", nil, nil},
+		{"varint", protoVarint(1, 300), protoMessage{{num: 1, wire: wireVarint, value: 300}}},
+		{"string", protoString(2, "hi"), protoMessage{{num: 2, wire: wireBytes, data: []byte("hi")}}},
+		{"fixed64", []byte{0x09, 1, 2, 3, 4, 5, 6, 7, 8}, protoMessage{{num: 1, wire: wireFixed64, value: 0x0807060504030201}}},
+		{"fixed32", []byte{0x15, 1, 2, 3, 4}, protoMessage{{num: 2, wire: wireFixed32, value: 0x04030201}}},
+		{"large field number", protoVarint(1000, 1), protoMessage{{num: 1000, wire: wireVarint, value: 1}}},
+		{
+			"several",
+			append(protoVarint(1, 1), protoString(1, "x")...),
+			protoMessage{{num: 1, wire: wireVarint, value: 1}, {num: 1, wire: wireBytes, data: []byte("x")}},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseProto(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseProtoInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated key", []byte{0x80}},
+		{"truncated varint", []byte{0x08, 0x80}},
+		{"missing varint", []byte{0x08}},
+		{"short fixed64", []byte{0x09, 1, 2, 3}},
+		{"short fixed32", []byte{0x15, 1, 2}},
+		{"bytes too long", []byte{0x12, 5, 'a', 'b'}},
+		{"huge length", []byte{0x12, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{"group", []byte{0x0b}},
+		{"wire type 7", []byte{0x0f}},
+	}
+	for _, tt := range tests {
+		if _, err := parseProto(tt.data); err != errProto {
+			t.Errorf("%s: got %v, want %v", tt.name, err, errProto)
+		}
+	}
+}
+
+func TestProtoFields(t *testing.T) {
+	var data []byte
+	for _, f := range [][]byte{
+		protoVarint(1, 1),
+		protoString(2, "first"),
+		protoVarint(1, 2),
+		protoString(2, "second"),
+		protoBytes(3, protoVarint(1, 10)),
+		protoBytes(3, []byte{0x80}),
+		protoBytes(3, protoVarint(1, 30)),
+	} {
+		data = append(data, f...)
+	}
+	m, err := parseProto(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := m.uint(1); got != 2 {
+		t.Errorf("uint(1) = %d, want the last value 2", got)
+	}
+	if got := m.string(2); got != "second" {
+		t.Errorf("string(2) = %q, want the last value", got)
+	}
+	if !m.has(3) || m.has(4) {
+		t.Errorf("has(3) = %v, has(4) = %v", m.has(3), m.has(4))
+	}
+	if got := m.message(3).uint(1); got != 30 {
+		t.Errorf("message(3).uint(1) = %d, want 30", got)
+	}
+	if got := m.message(4); got != nil || got.uint(1) != 0 || got.string(1) != "" {
+		t.Errorf("message(4) = %+v, want an empty message", got)
+	}
+
+	var values []uint64
+	for _, sub := range m.messages(3) {
+		values = append(values, sub.uint(1))
+	}
+	if want := []uint64{10, 30}; !reflect.DeepEqual(values, want) {
+		t.Errorf("messages(3) = %v, want %v without the invalid one", values, want)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Top level directories presenting voicemail and voice memos by their metadata.
+const (
+	voicemailDir  = "Voicemail"
+	voiceMemosDir = "Voice Memos"
+)
+
+// Location of voicemail in the backup.  Each message is stored as <ROWID>.amr.
+const (
+	voicemailDomain = "HomeDomain"
+	voicemailPath   = "Library/Voicemail/voicemail.db"
+)
+
+// voiceMemoStore is a place voice memos have been kept, in different versions of iOS.
+type voiceMemoStore struct {
+	domain string
+	db     string
+	table  string
+	dir    string
+}
+
+var voiceMemoStores = []voiceMemoStore{
+	{"AppDomainGroup-group.com.apple.VoiceMemos.shared", "Recordings/CloudRecordings.db", "ZCLOUDRECORDING", "Recordings"},
+	{mediaDomain, "Media/Recordings/CloudRecordings.db", "ZCLOUDRECORDING", "Media/Recordings"},
+	{mediaDomain, "Media/Recordings/Recordings.db", "ZRECORDING", "Media/Recordings"},
+}
+
+// recordingName names a recording after its date, in a form usable on any platform, and a
+// description (eg: "2020-01-06 10-40-00 Alice Smith.amr").
+func recordingName(dir *DirNode, date time.Time, desc, ext string) string {
+	name := date.Local().Format("2006-01-02 15-04-05")
+	if desc = strings.TrimSpace(desc); desc != "" {
+		name += " " + desc
+	}
+	return uniqueName(dir, safeName(name+ext))
+}
+
+// addVoicemailView adds Voicemail/ with each message named by its date and caller, and
+// deleted messages in Voicemail/Deleted/.
+func addVoicemailView(root *DirNode) error {
+	addViewDir(root, voicemailDir, func(d *DirNode) error {
+		return populateVoicemail(root, d)
+	})
+	return nil
+}
+
+func populateVoicemail(root, d *DirNode) error {
+	file, err := backupDB(root, voicemailDomain, voicemailPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.Query(`select ROWID, coalesce(date,0), coalesce(sender,''), ` +
+		columnOr(db, "voicemail", "callback_num", "''") + `, ` + columnOr(db, "voicemail", "trashed_date", "0") +
+		` from voicemail order by date`)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var id, date int64
+		var sender, callback string
+		var trashed float64
+		if err := r.Scan(&id, &date, &sender, &callback, &trashed); err != nil {
+			return err
+		}
+
+		f, err := backupFile(root, voicemailDomain, fmt.Sprintf("Library/Voicemail/%d.amr", id))
+		if err != nil {
+			debug("Voicemail %d: %v", id, err)
+			continue
+		}
+
+		caller := sender
+		if caller == "" {
+			caller = callback
+		}
+		if caller == "" {
+			caller = "Unknown"
+		} else {
+			caller = contactName(root, caller)
+		}
+
+		dir := d
+		if trashed > 0 {
+			dir = d.Subdir("Deleted", voicemailDomain)
+		}
+		when := time.Unix(date, 0)
+		name := recordingName(dir, when, caller, ".amr")
+		dir.entries[name] = f.withTime(name, when)
+	}
+	return r.Err()
+}
+
+// addVoiceMemosView adds "Voice Memos/" with each recording named by its date and title.
+func addVoiceMemosView(root *DirNode) error {
+	addViewDir(root, voiceMemosDir, func(d *DirNode) error {
+		return populateVoiceMemos(root, d)
+	})
+	return nil
+}
+
+func populateVoiceMemos(root, d *DirNode) error {
+	var err error
+	for _, store := range voiceMemoStores {
+		var file string
+		if file, err = backupDB(root, store.domain, store.db); err == nil {
+			return addVoiceMemos(root, d, store, file)
+		}
+	}
+	return err
+}
+
+func addVoiceMemos(root, d *DirNode, store voiceMemoStore, file string) error {
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	title := columnOr(db, store.table, "ZENCRYPTEDTITLE", columnOr(db, store.table, "ZCUSTOMLABEL", "''"))
+	r, err := db.Query("select coalesce(ZDATE,0), " + title + ", coalesce(ZPATH,'') from " + store.table + " order by ZDATE")
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for r.Next() {
+		var date float64
+		var label, file string
+		if err := r.Scan(&date, &label, &file); err != nil {
+			return err
+		}
+		if file == "" {
+			continue
+		}
+
+		// The path may be absolute, from where the recordings were on the device
+		base := path.Base(file)
+		f, err := backupFile(root, store.domain, store.dir+"/"+base)
+		if err != nil {
+			debug("Voice memo %s: %v", file, err)
+			continue
+		}
+
+		when := appleTime(date)
+		name := recordingName(d, when, label, path.Ext(base))
+		d.entries[name] = f.withTime(name, when)
+	}
+	return r.Err()
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRecordingName(t *testing.T) {
+	savedLocal := time.Local
+	defer func() { time.Local = savedLocal }()
+	time.Local = time.FixedZone("", -5*3600)
+
+	saved := global
+	defer func() { global = saved }()
+	global.Escape = escapeNone
+
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	d.entries["2020-01-06 05-40-00 Taken.m4a"] = &FileNode{}
+	d.entries["2020-01-06 05-40-00 Taken (1).m4a"] = &FileNode{}
+	date := time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC)
+
+	tests := []struct {
+		desc string
+		ext  string
+		want string
+	}{
+		{"Alice Smith", ".amr", "2020-01-06 05-40-00 Alice Smith.amr"},
+		{"  Padded  ", ".m4a", "2020-01-06 05-40-00 Padded.m4a"},
+		{"", ".m4a", "2020-01-06 05-40-00.m4a"},
+		{" ", ".amr", "2020-01-06 05-40-00.amr"},
+		{"Work/Home", ".m4a", "2020-01-06 05-40-00 Work_Home.m4a"},
+		{"Taken", ".m4a", "2020-01-06 05-40-00 Taken (2).m4a"},
+	}
+	for _, tt := range tests {
+		if got := recordingName(d, date, tt.desc, tt.ext); got != tt.want {
+			t.Errorf("recordingName(%q, %q) = %q, want %q", tt.desc, tt.ext, got, tt.want)
+		}
+	}
+}
+
+func TestWithTime(t *testing.T) {
+	f := &FileNode{inode: nextID(), name: "1.amr", domain: voicemailDomain, id: "abc"}
+	when := time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC)
+	g := f.withTime("2020-01-06 10-40-00 Alice.amr", when)
+
+	if g.inode == f.inode || g.name != "2020-01-06 10-40-00 Alice.amr" || g.Original() != "1.amr" ||
+		g.domain != f.domain || g.id != f.id || !g.mtime.Equal(when) {
+		t.Errorf("got %+v", g)
+	}
+	if !f.mtime.IsZero() {
+		t.Errorf("original changed: %+v", f)
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"io"
+	"strings"
+	"time"
+
+	"howett.net/plist"
+)
+
+// Top level directory holding Safari's history, bookmarks and reading list.
+const safariDir = "Safari"
+
+// Safari's databases are in the app's container from iOS 15, and the home domain before.
+var safariDomains = []string{"AppDomain-com.apple.mobilesafari", "HomeDomain"}
+
+const (
+	safariHistoryPath   = "Library/Safari/History.db"
+	safariBookmarksPath = "Library/Safari/Bookmarks.db"
+)
+
+// Bookmark types, and the titles of the special folders.
+const (
+	bookmarkFolder    = 1
+	bookmarksBar      = "BookmarksBar"
+	bookmarksMenu     = "BookmarksMenu"
+	bookmarksReadList = "com.apple.ReadingList"
+)
+
+// The files in Safari/.
+const (
+	safariHistory   = "history.csv"
+	safariBookmarks = "bookmarks.html"
+	safariReadList  = "reading-list.html"
+)
+
+// HistoryRecord is a visit to a page in Safari's history.
+type HistoryRecord struct {
+	Date  time.Time
+	URL   string
+	Title string
+}
+
+func (r *HistoryRecord) csvHeader() []string {
+	return []string{"date", "url", "title"}
+}
+
+func (r *HistoryRecord) csvRow() []string {
+	return []string{r.Date.Format(time.RFC3339), r.URL, r.Title}
+}
+
+// bookmark is a bookmark or folder from Bookmarks.db.
+type bookmark struct {
+	id       int64
+	title    string
+	url      string
+	folder   bool
+	added    time.Time
+	preview  string
+	children []*bookmark
+}
+
+// addSafariView adds Safari/ holding the browsing history as CSV, and the bookmarks and
+// reading list as HTML bookmark files which browsers can import.
+func addSafariView(root *DirNode) error {
+	addViewDir(root, safariDir, func(d *DirNode) error {
+		history, bookmarks := safariDomain(safariHistoryPath), safariDomain(safariBookmarksPath)
+		d.entries[safariHistory] = newVirtualWriter(safariHistory, history, func(w io.Writer) error {
+			return writeHistory(root, w)
+		})
+		d.entries[safariBookmarks] = newVirtualWriter(safariBookmarks, bookmarks, func(w io.Writer) error {
+			return writeBookmarks(root, false, w)
+		})
+		d.entries[safariReadList] = newVirtualWriter(safariReadList, bookmarks, func(w io.Writer) error {
+			return writeBookmarks(root, true, w)
+		})
+		return nil
+	})
+	return nil
+}
+
+// safariDomain returns the domain holding one of Safari's databases, being the last one
+// tried if it is in neither.
+func safariDomain(path string) string {
+	for _, domain := range safariDomains {
+		if _, err := global.db.FindFile(domain, path); err == nil {
+			return domain
+		}
+	}
+	return safariDomains[len(safariDomains)-1]
+}
+
+// safariDB returns the local file holding one of Safari's databases.
+func safariDB(root *DirNode, path string) (string, error) {
+	return backupDB(root, safariDomain(path), path)
+}
+
+// writeHistory writes every visit in the history, newest first.
+func writeHistory(root *DirNode, w io.Writer) error {
+	file, err := safariDB(root, safariHistoryPath)
+	if err != nil {
+		return err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	r, err := db.Query(`select coalesce(v.visit_time,0), coalesce(i.url,''), coalesce(v.title,'')
+		from history_visits v join history_items i on i.id = v.history_item order by v.visit_time desc`)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	rw := newRecordWriter(w, formatCSV)
+	for r.Next() {
+		var date float64
+		h := &HistoryRecord{}
+		if err := r.Scan(&date, &h.URL, &h.Title); err != nil {
+			return err
+		}
+		h.Date = appleTime(date).UTC()
+		if err := rw.Write(h); err != nil {
+			return err
+		}
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	return rw.Close()
+}
+
+// readBookmarks reads the tree of bookmarks, returning the root folder.
+func readBookmarks(root *DirNode) (*bookmark, error) {
+	file, err := safariDB(root, safariBookmarksPath)
+	if err != nil {
+		return nil, err
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	r, err := db.Query(`select id, coalesce(parent,-1), coalesce(type,0), coalesce(title,''), coalesce(url,''),
+		` + columnOr(db, "bookmarks", "extra_attributes", "null") + ` from bookmarks
+		where ` + columnOr(db, "bookmarks", "hidden", "0") + ` = 0 order by parent, order_index, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	top := &bookmark{folder: true}
+	byID := map[int64]*bookmark{0: top}
+	parents := make(map[int64]int64)
+	var order []*bookmark
+	for r.Next() {
+		var parent int64
+		var kind int
+		var extra []byte
+		b := &bookmark{}
+		if err := r.Scan(&b.id, &parent, &kind, &b.title, &b.url, &extra); err != nil {
+			return nil, err
+		}
+		if b.id == 0 {
+			continue
+		}
+		b.folder = kind == bookmarkFolder
+		readListAttributes(b, extra)
+		byID[b.id] = b
+		parents[b.id] = parent
+		order = append(order, b)
+	}
+	if err := r.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, b := range order {
+		if p, ok := byID[parents[b.id]]; ok {
+			p.children = append(p.children, b)
+		}
+	}
+	return top, nil
+}
+
+// readListAttributes adds the date added and preview text of a reading list item, from the
+// property list of extra attributes.
+func readListAttributes(b *bookmark, extra []byte) {
+	if extra == nil {
+		return
+	}
+	var attrs struct {
+		ReadingList struct {
+			DateAdded   time.Time
+			PreviewText string
+		} `plist:"com.apple.ReadingList"`
+	}
+	if _, err := plist.Unmarshal(extra, &attrs); err != nil {
+		debug("Bookmark %d: %v", b.id, err)
+		return
+	}
+	b.added = attrs.ReadingList.DateAdded
+	b.preview = attrs.ReadingList.PreviewText
+}
+
+// writeBookmarks writes the bookmarks, or the reading list, in the Netscape bookmark file
+// format.  The bookmarks bar becomes the toolbar folder, named Favorites as on the device.
+func writeBookmarks(root *DirNode, readList bool, w io.Writer) error {
+	top, err := readBookmarks(root)
+	if err != nil {
+		return err
+	}
+
+	title := "Bookmarks"
+	if readList {
+		title = "Reading List"
+	}
+	var b strings.Builder
+	b.WriteString("<!DOCTYPE NETSCAPE-Bookmark-file-1>\n")
+	b.WriteString("<META HTTP-EQUIV=\"Content-Type\" CONTENT=\"text/html; charset=UTF-8\">\n")
+	fmt.Fprintf(&b, "<TITLE>%s</TITLE>\n<H1>%s</H1>\n<DL><p>\n", title, title)
+
+	for _, c := range top.children {
+		if c.title == bookmarksReadList {
+			if readList {
+				writeBookmarkList(&b, c.children, 1)
+			}
+			continue
+		}
+		if readList {
+			continue
+		}
+		switch c.title {
+		case bookmarksBar:
+			b.WriteString("    <DT><H3 PERSONAL_TOOLBAR_FOLDER=\"true\">Favorites</H3>\n")
+			writeBookmarkFolder(&b, c.children, 1)
+		case bookmarksMenu:
+			writeBookmarkList(&b, c.children, 1)
+		default:
+			writeBookmarkList(&b, []*bookmark{c}, 1)
+		}
+	}
+	b.WriteString("</DL><p>\n")
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// writeBookmarkFolder writes the contents of a folder as a nested list.
+func writeBookmarkFolder(b *strings.Builder, list []*bookmark, depth int) {
+	indent := strings.Repeat("    ", depth)
+	b.WriteString(indent + "<DL><p>\n")
+	writeBookmarkList(b, list, depth+1)
+	b.WriteString(indent + "</DL><p>\n")
+}
+
+// writeBookmarkList writes bookmarks and folders.
+func writeBookmarkList(b *strings.Builder, list []*bookmark, depth int) {
+	indent := strings.Repeat("    ", depth)
+	for _, m := range list {
+		if m.folder {
+			fmt.Fprintf(b, "%s<DT><H3>%s</H3>\n", indent, html.EscapeString(m.title))
+			writeBookmarkFolder(b, m.children, depth)
+			continue
+		}
+		if m.url == "" {
+			continue
+		}
+		title := m.title
+		if title == "" {
+			title = m.url
+		}
+		added := ""
+		if !m.added.IsZero() {
+			added = fmt.Sprintf(" ADD_DATE=\"%d\"", m.added.Unix())
+		}
+		fmt.Fprintf(b, "%s<DT><A HREF=\"%s\"%s>%s</A>\n", indent, html.EscapeString(m.url), added, html.EscapeString(title))
+		if m.preview != "" {
+			fmt.Fprintf(b, "%s<DD>%s\n", indent, html.EscapeString(m.preview))
+		}
+	}
+}
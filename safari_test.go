@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"howett.net/plist"
+)
+
+func TestSafariDomain(t *testing.T) {
+	file := testDB(t,
+		"create table files (fileID text, domain text, relativePath text, flags integer)",
+		"insert into files values ('h1', 'AppDomain-com.apple.mobilesafari', 'Library/Safari/History.db', 1)",
+		"insert into files values ('h2', 'HomeDomain', 'Library/Safari/History.db', 1)",
+		"insert into files values ('b1', 'HomeDomain', 'Library/Safari/Bookmarks.db', 1)",
+	)
+	conn, err := openSQLite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	saved := global
+	defer func() { global = saved }()
+	global.db = DB{conn}
+
+	tests := []struct {
+		path string
+		want string
+	}{
+		{safariHistoryPath, "AppDomain-com.apple.mobilesafari"},
+		{safariBookmarksPath, "HomeDomain"},
+		{"Library/Safari/Missing.db", "HomeDomain"},
+	}
+	for _, tt := range tests {
+		if got := safariDomain(tt.path); got != tt.want {
+			t.Errorf("safariDomain(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestReadListAttributes(t *testing.T) {
+	added := time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC)
+	data, err := plist.Marshal(map[string]any{
+		"com.apple.ReadingList": map[string]any{"DateAdded": added, "PreviewText": "A preview"},
+	}, plist.BinaryFormat)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		extra   []byte
+		added   time.Time
+		preview string
+	}{
+		{"attributes", data, added, "A preview"},
+		{"none", nil, time.Time{}, ""},
+		{"invalid", []byte("not a plist"), time.Time{}, ""},
+	}
+	for _, tt := range tests {
+		b := &bookmark{}
+		readListAttributes(b, tt.extra)
+		if !b.added.Equal(tt.added) || b.preview != tt.preview {
+			t.Errorf("%s: got %v %q, want %v %q", tt.name, b.added, b.preview, tt.added, tt.preview)
+		}
+	}
+}
+
+func TestWriteBookmarkList(t *testing.T) {
+	tests := []struct {
+		name string
+		list []*bookmark
+		want string
+	}{
+		{
+			name: "bookmark",
+			list: []*bookmark{{title: "Example", url: "https://example.com/?a=1&b=2"}},
+			want: "    <DT><A HREF=\"https://example.com/?a=1&amp;b=2\">Example</A>\n",
+		},
+		{
+			name: "untitled",
+			list: []*bookmark{{url: "https://example.com/"}},
+			want: "    <DT><A HREF=\"https://example.com/\">https://example.com/</A>\n",
+		},
+		{
+			name: "reading list item",
+			list: []*bookmark{{title: "<Story>", url: "https://example.com/story",
+				added: time.Unix(1578307200, 0), preview: "It began"}},
+			want: "    <DT><A HREF=\"https://example.com/story\" ADD_DATE=\"1578307200\">&lt;Story&gt;</A>\n    <DD>It began\n",
+		},
+		{
+			name: "no url",
+			list: []*bookmark{{title: "Nowhere"}},
+			want: "",
+		},
+		{
+			name: "folders",
+			list: []*bookmark{{title: "News", folder: true, children: []*bookmark{
+				{title: "Paper", url: "https://paper.example"},
+				{title: "Empty", folder: true},
+			}}},
+			want: `    <DT><H3>News</H3>
+    <DL><p>
+        <DT><A HREF="https://paper.example">Paper</A>
+        <DT><H3>Empty</H3>
+        <DL><p>
+        </DL><p>
+    </DL><p>
+`,
+		},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		writeBookmarkList(&b, tt.list, 1)
+		if b.String() != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, b.String(), tt.want)
+		}
+	}
+}
+
+func TestHistoryRow(t *testing.T) {
+	r := &HistoryRecord{Date: time.Date(2020, 1, 6, 10, 40, 0, 0, time.UTC), URL: "https://example.com/", Title: "Example"}
+	got := r.csvRow()
+	if len(got) != len(r.csvHeader()) || got[0] != "2020-01-06T10:40:00Z" || got[1] != r.URL || got[2] != r.Title {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Source provides access to the files making up a backup (Manifest.db, Info.plist and the
+// file blobs), regardless of whether the backup is a plain directory or stored in an archive.
+// Names are always slash separated and relative to the backup root (eg: "ab/ab12cd...").
+type Source interface {
+	Open(name string) (io.ReadSeekCloser, error)
+	Stat(name string) (fs.FileInfo, error)
+	// Local returns the name of a file on disk holding the contents of name, extracting it
+	// to a temporary file if needed.  Used for anything SQLite has to open itself.
+	Local(name string) (string, error)
+	// Path returns a descriptive location of name, suitable for messages and xattrs.
+	Path(name string) string
+	Close() error
+}
+
+// OpenSource selects a backup source based on the type of root.  Directories are used as is,
+// zip files are read in place, and uncompressed tar files are indexed once then read in place.
+func OpenSource(root string) (Source, error) {
+	debug("OpenSource Called: %s", root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		return &dirSource{root: root}, nil
+	}
+
+	lower := strings.ToLower(root)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return openZipSource(root)
+	case strings.HasSuffix(lower, ".tar"):
+		return openTarSource(root)
+	case strings.HasSuffix(lower, ".tgz"), strings.HasSuffix(lower, ".tar.gz"),
+		strings.HasSuffix(lower, ".tar.bz2"), strings.HasSuffix(lower, ".tar.xz"):
+		return nil, fmt.Errorf("%s: compressed tar archives can not be read in place, use zip or an uncompressed tar", root)
+	}
+	return nil, fmt.Errorf("%s: unsupported backup source, expected a directory, zip or tar file", root)
+}
+
+// blobName returns the name of the blob holding the contents of file id.
+func blobName(id string) string {
+	return path.Join(id[0:2], id)
+}
+
+// memberName cleans the name of an archive member, which may have redundant elements such
+// as a leading "./".
+func memberName(name string) string {
+	return strings.TrimPrefix(path.Clean(name), "./")
+}
+
+// findPrefix locates the directory holding Manifest.db within an archive, as backups are
+// usually archived along with their enclosing (device id) directory.
+func findPrefix(names []string) (string, error) {
+	prefix := ""
+	found := false
+	for _, n := range names {
+		if path.Base(n) != "Manifest.db" {
+			continue
+		}
+		dir := path.Dir(n)
+		if dir == "." {
+			dir = ""
+		}
+		if !found || len(dir) < len(prefix) {
+			prefix = dir
+			found = true
+		}
+	}
+	if !found {
+		return "", errors.New("Manifest.db not found in archive")
+	}
+	return prefix, nil
+}
+
+// extractTemp copies r into a new temporary file, returning its name.
+func extractTemp(name string, r io.Reader) (string, error) {
+	dir, err := tempDir()
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, "*-"+path.Base(name))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err = io.Copy(f, r); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// dirSource is an unpacked backup directory.
+type dirSource struct {
+	root string
+}
+
+func (s *dirSource) Open(name string) (io.ReadSeekCloser, error) {
+	return os.Open(s.Path(name))
+}
+
+func (s *dirSource) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(s.Path(name))
+}
+
+func (s *dirSource) Local(name string) (string, error) {
+	return s.Path(name), nil
+}
+
+func (s *dirSource) Path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *dirSource) Close() error {
+	return nil
+}
+
+// archiveSource holds what is common to the archive based sources.  Files extracted via
+// Local() are remembered so they are only extracted once.
+type archiveSource struct {
+	sync.Mutex
+	archive string
+	prefix  string
+	local   map[string]string
+}
+
+func (s *archiveSource) Path(name string) string {
+	return s.archive + "!/" + path.Join(s.prefix, name)
+}
+
+func (s *archiveSource) extract(name string, open func(string) (io.ReadSeekCloser, error)) (string, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if l, ok := s.local[name]; ok {
+		return l, nil
+	}
+
+	r, err := open(name)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	debug("Extracting %s", s.Path(name))
+	l, err := extractTemp(name, r)
+	if err != nil {
+		return "", err
+	}
+	s.local[name] = l
+	return l, nil
+}
+
+func (s *archiveSource) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	for n, l := range s.local {
+		os.Remove(l)
+		delete(s.local, n)
+	}
+	return nil
+}
+
+// zipSource reads a backup from within a zip file.  Stored entries are read directly from
+// the archive, compressed entries are decompressed as they are read.
+type zipSource struct {
+	archiveSource
+	zf    *zip.ReadCloser
+	files map[string]*zip.File
+}
+
+func openZipSource(archive string) (Source, error) {
+	zf, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+
+	names := make([]string, 0, len(zf.File))
+	for _, f := range zf.File {
+		names = append(names, memberName(f.Name))
+	}
+
+	prefix, err := findPrefix(names)
+	if err != nil {
+		zf.Close()
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+
+	s := &zipSource{
+		archiveSource: archiveSource{archive: archive, prefix: prefix, local: make(map[string]string)},
+		zf:            zf,
+		files:         make(map[string]*zip.File),
+	}
+	for i, f := range zf.File {
+		s.files[names[i]] = f
+	}
+	return s, nil
+}
+
+func (s *zipSource) entry(name string) (*zip.File, error) {
+	if f, ok := s.files[path.Join(s.prefix, name)]; ok {
+		return f, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: s.Path(name), Err: fs.ErrNotExist}
+}
+
+func (s *zipSource) Open(name string) (io.ReadSeekCloser, error) {
+	f, err := s.entry(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Method == zip.Store {
+		offset, err := f.DataOffset()
+		if err != nil {
+			return nil, err
+		}
+		fh, err := os.Open(s.archive)
+		if err != nil {
+			return nil, err
+		}
+		return &sectionFile{SectionReader: io.NewSectionReader(fh, offset, int64(f.UncompressedSize64)), fh: fh}, nil
+	}
+
+	return &zipReader{f: f, size: int64(f.UncompressedSize64)}, nil
+}
+
+func (s *zipSource) Stat(name string) (fs.FileInfo, error) {
+	f, err := s.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.FileInfo(), nil
+}
+
+func (s *zipSource) Local(name string) (string, error) {
+	return s.extract(name, s.Open)
+}
+
+func (s *zipSource) Close() error {
+	s.archiveSource.Close()
+	return s.zf.Close()
+}
+
+// zipReader provides seeking within a compressed zip entry.  Seeking forward discards data,
+// seeking backwards restarts decompression from the start of the entry.
+type zipReader struct {
+	f    *zip.File
+	rc   io.ReadCloser
+	pos  int64
+	off  int64
+	size int64
+}
+
+func (z *zipReader) Read(p []byte) (n int, err error) {
+	if z.off >= z.size {
+		return 0, io.EOF
+	}
+
+	if z.rc == nil || z.off < z.pos {
+		if z.rc != nil {
+			z.rc.Close()
+		}
+		if z.rc, err = z.f.Open(); err != nil {
+			return 0, err
+		}
+		z.pos = 0
+	}
+
+	if z.off > z.pos {
+		skipped, err := io.CopyN(io.Discard, z.rc, z.off-z.pos)
+		z.pos += skipped
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = z.rc.Read(p)
+	z.pos += int64(n)
+	z.off = z.pos
+	return n, err
+}
+
+func (z *zipReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += z.off
+	case io.SeekEnd:
+		offset += z.size
+	default:
+		return 0, errors.New("zipReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("zipReader.Seek: negative position")
+	}
+	z.off = offset
+	return offset, nil
+}
+
+func (z *zipReader) Close() error {
+	if z.rc != nil {
+		return z.rc.Close()
+	}
+	return nil
+}
+
+// sectionFile is a section of an archive opened for reading.
+type sectionFile struct {
+	*io.SectionReader
+	fh *os.File
+}
+
+func (s *sectionFile) Close() error {
+	return s.fh.Close()
+}
+
+// tarSource reads a backup from within an uncompressed tar file.  The archive is scanned
+// once to find where each file is stored, after which files are read in place.
+type tarSource struct {
+	archiveSource
+	files map[string]*tarEntry
+}
+
+type tarEntry struct {
+	hdr    *tar.Header
+	offset int64
+}
+
+func openTarSource(archive string) (Source, error) {
+	fh, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	debug("Indexing %s", archive)
+	files := make(map[string]*tarEntry)
+	names := make([]string, 0, 1000)
+
+	tr := tar.NewReader(fh)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", archive, err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		// The tar reader does not buffer, so the file position is now the start of the data.
+		offset, err := fh.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		name := memberName(hdr.Name)
+		files[name] = &tarEntry{hdr: hdr, offset: offset}
+		names = append(names, name)
+	}
+
+	prefix, err := findPrefix(names)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", archive, err)
+	}
+
+	debug("Indexed %d files", len(files))
+	return &tarSource{
+		archiveSource: archiveSource{archive: archive, prefix: prefix, local: make(map[string]string)},
+		files:         files,
+	}, nil
+}
+
+func (s *tarSource) entry(name string) (*tarEntry, error) {
+	if e, ok := s.files[path.Join(s.prefix, name)]; ok {
+		return e, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: s.Path(name), Err: fs.ErrNotExist}
+}
+
+func (s *tarSource) Open(name string) (io.ReadSeekCloser, error) {
+	e, err := s.entry(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fh, err := os.Open(s.archive)
+	if err != nil {
+		return nil, err
+	}
+	return &sectionFile{SectionReader: io.NewSectionReader(fh, e.offset, e.hdr.Size), fh: fh}, nil
+}
+
+func (s *tarSource) Stat(name string) (fs.FileInfo, error) {
+	e, err := s.entry(name)
+	if err != nil {
+		return nil, err
+	}
+	return e.hdr.FileInfo(), nil
+}
+
+func (s *tarSource) Local(name string) (string, error) {
+	return s.extract(name, s.Open)
+}
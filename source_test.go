@@ -0,0 +1,215 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// member is a file stored in a test archive.
+type member struct {
+	name string
+	data string
+}
+
+func writeZip(t *testing.T, name string, members []member) {
+	t.Helper()
+	fh, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	zw := zip.NewWriter(fh)
+	for i, m := range members {
+		// Alternate between stored and compressed members, which are read differently
+		method := zip.Store
+		if i%2 == 1 {
+			method = zip.Deflate
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: m.name, Method: method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTar(t *testing.T, name string, members []member) {
+	t.Helper()
+	fh, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	tw := tar.NewWriter(fh)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Mode: 0644, Size: int64(len(m.data)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(tw, m.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestArchiveSources(t *testing.T) {
+	tests := []struct {
+		name    string
+		members []member
+	}{
+		{
+			name: "plain",
+			members: []member{
+				{"Manifest.db", "manifest"},
+				{"ab/ab12", "blob"},
+			},
+		},
+		{
+			name: "dot prefix",
+			members: []member{
+				{"./Manifest.db", "manifest"},
+				{"./ab/ab12", "blob"},
+			},
+		},
+		{
+			name: "device directory",
+			members: []member{
+				{"00008030-001/Manifest.db", "manifest"},
+				{"00008030-001/ab/ab12", "blob"},
+				{"00008030-001/Snapshot/Manifest.db", "old"},
+			},
+		},
+		{
+			name: "redundant elements",
+			members: []member{
+				{"./00008030-001/./Manifest.db", "manifest"},
+				{"00008030-001//ab/./ab12", "blob"},
+			},
+		},
+	}
+
+	formats := []struct {
+		ext   string
+		write func(*testing.T, string, []member)
+	}{
+		{".zip", writeZip},
+		{".tar", writeTar},
+	}
+
+	for _, tt := range tests {
+		for _, f := range formats {
+			t.Run(tt.name+f.ext, func(t *testing.T) {
+				defer func(tmp string) {
+					os.RemoveAll(global.tmp)
+					global.tmp = tmp
+				}(global.tmp)
+				global.tmp = ""
+
+				archive := filepath.Join(t.TempDir(), "backup"+f.ext)
+				f.write(t, archive, tt.members)
+
+				src, err := OpenSource(archive)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer src.Close()
+
+				for name, want := range map[string]string{"Manifest.db": "manifest", "ab/ab12": "blob"} {
+					fh, err := src.Open(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					data, err := io.ReadAll(fh)
+					fh.Close()
+					if err != nil || string(data) != want {
+						t.Errorf("Open(%q) = %q, %v, want %q", name, data, err, want)
+					}
+
+					info, err := src.Stat(name)
+					if err != nil || info.Size() != int64(len(want)) {
+						t.Errorf("Stat(%q) = %v, %v, want size %d", name, info, err, len(want))
+					}
+
+					local, err := src.Local(name)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if data, err := os.ReadFile(local); err != nil || string(data) != want {
+						t.Errorf("Local(%q) holds %q, %v, want %q", name, data, err, want)
+					}
+				}
+
+				if _, err := src.Open("ab/missing"); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Open of a missing file returned %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestArchiveWithoutManifest(t *testing.T) {
+	for _, ext := range []string{".zip", ".tar"} {
+		archive := filepath.Join(t.TempDir(), "backup"+ext)
+		if ext == ".zip" {
+			writeZip(t, archive, []member{{"Info.plist", "info"}})
+		} else {
+			writeTar(t, archive, []member{{"Info.plist", "info"}})
+		}
+		if _, err := OpenSource(archive); err == nil {
+			t.Errorf("%s: opened an archive without Manifest.db", ext)
+		}
+	}
+}
+
+func TestSeekCompressedZip(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "backup.zip")
+	writeZip(t, archive, []member{{"Manifest.db", "manifest"}, {"ab/ab12", "0123456789"}})
+
+	src, err := OpenSource(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	fh, err := src.Open("ab/ab12")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fh.Close()
+
+	tests := []struct {
+		offset int64
+		whence int
+		want   string
+	}{
+		{4, io.SeekStart, "45"},
+		{2, io.SeekCurrent, "89"},
+		{1, io.SeekStart, "12"},
+		{-3, io.SeekEnd, "78"},
+	}
+	for _, tt := range tests {
+		if _, err := fh.Seek(tt.offset, tt.whence); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2)
+		if _, err := io.ReadFull(fh, buf); err != nil || string(buf) != tt.want {
+			t.Errorf("Seek(%d, %d) read %q, %v, want %q", tt.offset, tt.whence, buf, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// sqliteURI returns the URI for opening file with the given query parameters.
+func sqliteURI(file, params string) string {
+	uri := "file:" + strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23").Replace(file)
+	if params != "" {
+		uri += "?" + params
+	}
+	return uri
+}
+
+// openSQLite opens a database read-only, as an immutable file so SQLite never attempts to
+// create a journal or lock the file.
+func openSQLite(file string) (*sql.DB, error) {
+	return sql.Open("sqlite3", sqliteURI(file, "immutable=1&mode=ro"))
+}
+
+// copyEntry copies the contents of f to the file named dst.
+func copyEntry(f FileEntry, dst string) error {
+	src, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	fh, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(fh, src); err != nil {
+		fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+// localFile returns the name of a file on disk holding the contents of f, as needed when
+// opening a database.
+func localFile(f FileEntry) (string, error) {
+	switch e := f.(type) {
+	case *FileNode:
+		if e.overlay != "" {
+			return e.overlay, nil
+		}
+		return global.src.Local(blobName(e.id))
+	case *VirtualNode:
+		return e.Generate()
+	}
+	return "", fmt.Errorf("%s: not a file", f.Name())
+}
+
+// isSQLite checks the header of f to see if it is an SQLite database.
+func isSQLite(f FileEntry) bool {
+	fh, err := f.Open()
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(fh, header); err != nil {
+		return false
+	}
+	return string(header) == "SQLite format 3\x00"
+}
+
+// quoteIdent quotes an SQL identifier, such as a table name.
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// hasColumn reports whether the table has the column, for tables which gained columns in
+// later versions of iOS.
+func hasColumn(db *sql.DB, table, column string) bool {
+	var n int
+	err := db.QueryRow("select count(*) from pragma_table_info(?) where name=?", table, column).Scan(&n)
+	return err == nil && n > 0
+}
+
+// columnOr returns an expression reading the column of the table, with null values
+// replaced by fallback, or just fallback if the table does not have the column.
+func columnOr(db *sql.DB, table, column, fallback string) string {
+	if !hasColumn(db, table, column) {
+		return fallback
+	}
+	if fallback == "null" {
+		return column
+	}
+	return "coalesce(" + column + "," + fallback + ")"
+}
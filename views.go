@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// view adds virtual content to the tree once the listing has been read.
+type view struct {
+	name    string
+	enabled func() bool
+	add     func(root *DirNode) error
+}
+
+var views = []view{
+	{"apps", func() bool { return global.AppNames && global.DomainDirs }, addAppsView},
+	{"wal", func() bool { return global.MergeWAL }, addWALView},
+	{"export", func() bool { return global.ExportDB }, addExportView},
+	{"plist", func() bool { return global.ConvPlist }, addPlistView},
+	{"messages", func() bool { return global.Messages }, addMessagesView},
+	{"contacts", func() bool { return global.Contacts }, addContactsView},
+	{"calendars", func() bool { return global.Calendars }, addCalendarsView},
+	{"calls", func() bool { return global.Calls }, addCallsView},
+	{"notes", func() bool { return global.Notes }, addNotesView},
+	{"voicemail", func() bool { return global.Recordings }, addVoicemailView},
+	{"voicememos", func() bool { return global.Recordings }, addVoiceMemosView},
+	{"photos", func() bool { return global.Photos }, addPhotosView},
+	{"xmp", func() bool { return global.XMP }, addXMPView},
+	{"safari", func() bool { return global.Safari }, addSafariView},
+}
+
+// reservedNames are top level directories created by views, which domain families must avoid.
+var reservedNames = map[string]bool{
+	appsDir:       true,
+	messagesDir:   true,
+	contactsDir:   true,
+	calendarsDir:  true,
+	callsDir:      true,
+	notesDir:      true,
+	voicemailDir:  true,
+	voiceMemosDir: true,
+	photosDir:     true,
+	safariDir:     true,
+}
+
+func addViews(root *DirNode) error {
+	for _, v := range views {
+		if v.enabled() {
+			debug("Adding view: %s", v.name)
+			if err := v.add(root); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backupFile returns the file at path within domain.  The entry in the tree is used when the
+// domain is mounted, so views share it, otherwise a new entry is made from the manifest.
+func backupFile(root *DirNode, domain, path string) (*FileNode, error) {
+	id, err := global.db.FindFile(domain, path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := strings.Split(path, "/")
+	for i := range p {
+		p[i] = mapName(p[i])
+	}
+	if global.DomainDirs {
+		p = append(parseDomain(domain).Dirs(), p...)
+	} else if !selectDomain(domain) {
+		p = nil
+	}
+	if p != nil {
+		if f, ok := lookupPath(root, strings.Join(p, "/")).(*FileNode); ok && f.id == id {
+			return f, nil
+		}
+	}
+
+	name := path[strings.LastIndex(path, "/")+1:]
+	return &FileNode{
+		inode:  nextID(),
+		name:   mapName(name),
+		orig:   name,
+		domain: domain,
+		id:     id,
+	}, nil
+}
+
+var (
+	viewDBLock sync.Mutex
+	viewDBs    = make(map[string]string)
+)
+
+// backupDB returns a local file holding the database at path within domain, for views to
+// read.  If the database has a write-ahead log, it is applied to a snapshot first so the
+// latest contents are seen.  Snapshots are shared by all the views using the database.
+func backupDB(root *DirNode, domain, path string) (string, error) {
+	viewDBLock.Lock()
+	defer viewDBLock.Unlock()
+
+	key := domain + "/" + path
+	if file, ok := viewDBs[key]; ok {
+		return file, nil
+	}
+
+	f, err := backupFile(root, domain, path)
+	if err != nil {
+		return "", err
+	}
+
+	var file string
+	if wal, err := backupFile(root, domain, path+"-wal"); err == nil {
+		dir, err := tempDir()
+		if err != nil {
+			return "", err
+		}
+		file = fmt.Sprintf("%s/%d-%s", dir, f.inode, walName(f.name))
+		if err := mergeWAL(f, wal, file); err != nil {
+			os.Remove(file)
+			return "", err
+		}
+	} else if file, err = localFile(f); err != nil {
+		return "", err
+	}
+
+	viewDBs[key] = file
+	return file, nil
+}
+
+// addViewDir adds the top level directory of a view, generated when first opened, unless
+// the name is already used by the backup (when a single domain is mounted at the root).
+func addViewDir(root *DirNode, name string, populate func(d *DirNode) error) {
+	if _, ok := root.entries[name]; ok {
+		debug("View directory name already in use: %s", name)
+		return
+	}
+	root.entries[name] = newLazyDir(name, "", populate)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// VirtualNode is a file which does not exist in the backup, but is generated from it.  The
+// contents are generated when the file is first opened (or its size is needed), and cached
+// in a temporary file from then on.
+type VirtualNode struct {
+	sync.Mutex
+	inode    uint64
+	name     string
+	domain   string
+	generate func(dst string) error
+	cache    string
+	err      error
+}
+
+// newVirtualNode creates a file generated by calling generate, which writes the contents to
+// the file named dst.
+func newVirtualNode(name, domain string, generate func(dst string) error) *VirtualNode {
+	return &VirtualNode{
+		inode:    nextID(),
+		name:     name,
+		domain:   domain,
+		generate: generate,
+	}
+}
+
+// newVirtualWriter creates a file generated by calling write with the file to write to.
+func newVirtualWriter(name, domain string, write func(w io.Writer) error) *VirtualNode {
+	return newVirtualNode(name, domain, func(dst string) error {
+		fh, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		if err = write(fh); err != nil {
+			fh.Close()
+			return err
+		}
+		return fh.Close()
+	})
+}
+
+// Generate creates the cached contents, if not done already.  Failures are remembered, so
+// the work is not repeated for every access.
+func (v *VirtualNode) Generate() (string, error) {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.cache != "" || v.err != nil {
+		return v.cache, v.err
+	}
+
+	debug("VirtualNode:Generate Called: %s", v.name)
+	dir, err := tempDir()
+	if err != nil {
+		return "", err
+	}
+	dst := fmt.Sprintf("%s/%d-%s", dir, v.inode, v.name)
+
+	if v.err = v.generate(dst); v.err != nil {
+		v.err = fmt.Errorf("%s: %w", v.name, v.err)
+		debug("VirtualNode:Generate failed: %v", v.err)
+		os.Remove(dst)
+		return "", v.err
+	}
+	v.cache = dst
+	return v.cache, nil
+}
+
+func (v *VirtualNode) Open() (io.ReadSeekCloser, error) {
+	debug("VirtualNode:Open Called")
+	file, err := v.Generate()
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(file)
+}
+
+func (v *VirtualNode) Stat() (fs.FileInfo, error) {
+	debug("VirtualNode:Stat Called")
+	file, err := v.Generate()
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(file)
+}
+
+func (v *VirtualNode) Add(id, domain, path string) error {
+	debug("VirtualNode:Add Called")
+	return nil
+}
+
+func (v *VirtualNode) Find(path string) NodeEntry {
+	debug("VirtualNode:Find Called")
+	return v
+}
+
+func (v *VirtualNode) Fullname() string {
+	debug("VirtualNode:Fullname Called")
+	return v.cache
+}
+
+func (v *VirtualNode) Name() string {
+	debug("VirtualNode:Name Called")
+	return v.name
+}
+
+func (v *VirtualNode) Original() string {
+	debug("VirtualNode:Original Called")
+	return v.name
+}
+
+func (v *VirtualNode) ID() string {
+	debug("VirtualNode:ID Called")
+	return ""
+}
+
+func (v *VirtualNode) Domain() string {
+	debug("VirtualNode:Domain Called")
+	return v.domain
+}
+
+func (v *VirtualNode) Dump() {
+	debug("VirtualNode:Dump Called")
+	fmt.Printf(" %s [ virtual ]\n", v.name)
+}
+
+func (v *VirtualNode) Inode() uint64 {
+	debug("VirtualNode:Inode Called")
+	return v.inode
+}
+
+// walkFiles calls fn for each file below d, giving the directory holding it.  Aliased and
+// generated directories are skipped, so each file from the backup is visited once.  The
+// files are collected before fn is called, so fn may add entries to the tree.
+func walkFiles(d *DirNode, fn func(dir *DirNode, name string, f *FileNode)) {
+	type found struct {
+		dir  *DirNode
+		name string
+		file *FileNode
+	}
+	var files []found
+
+	var walk func(d *DirNode)
+	walk = func(d *DirNode) {
+		for _, n := range d.sortedNames() {
+			switch e := d.entries[n].(type) {
+			case *DirNode:
+				if e.target == nil && e.populate == nil {
+					walk(e)
+				}
+			case *FileNode:
+				files = append(files, found{d, n, e})
+			}
+		}
+	}
+	walk(d)
+
+	for _, f := range files {
+		fn(f.dir, f.name, f.file)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+)
+
+// walName returns the name of the merged snapshot of a database, eg: "sms.db" gives
+// "sms.merged.db".
+func walName(name string) string {
+	base, ext := splitExt(name)
+	return base + ".merged" + ext
+}
+
+// mergeWAL creates a snapshot of the database at dst, with the committed contents of its
+// write-ahead log applied.  Only copies are changed, never the backup itself.
+func mergeWAL(db, wal FileEntry, dst string) error {
+	if err := copyEntry(db, dst); err != nil {
+		return err
+	}
+	if err := copyEntry(wal, dst+"-wal"); err != nil {
+		return err
+	}
+	defer os.Remove(dst + "-wal")
+	defer os.Remove(dst + "-shm")
+
+	conn, err := sql.Open("sqlite3", sqliteURI(dst, ""))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	// Leaving WAL mode also leaves the snapshot usable on its own, on a read-only mount
+	if _, err = conn.Exec("PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return err
+	}
+	if _, err = conn.Exec("PRAGMA journal_mode=DELETE"); err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// addWALView adds a merged snapshot next to each database which has a write-ahead log, so
+// the latest committed state can be seen without applying the log to the backup.
+func addWALView(root *DirNode) error {
+	walkFiles(root, func(dir *DirNode, name string, f *FileNode) {
+		wal, ok := dir.entries[name+"-wal"].(*FileNode)
+		if !ok {
+			return
+		}
+
+		snapshot := walName(name)
+		if _, ok := dir.entries[snapshot]; ok {
+			debug("WAL snapshot name already in use: %s", snapshot)
+			return
+		}
+		dir.entries[snapshot] = newVirtualNode(snapshot, f.domain, func(dst string) error {
+			return mergeWAL(f, wal, dst)
+		})
+	})
+	return nil
+}
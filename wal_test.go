@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"sms.db", "sms.merged.db"},
+		{"Photos.sqlite", "Photos.merged.sqlite"},
+		{"a.b.db", "a.b.merged.db"},
+		{"history", "history.merged"},
+		{".hidden", ".hidden.merged"},
+	}
+	for _, tt := range tests {
+		if got := walName(tt.name); got != tt.want {
+			t.Errorf("walName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// walDB creates a database in dir whose last rows are only in its write-ahead log, returning
+// copies of the database and log as they would be found in a backup.
+func walDB(t *testing.T, dir string) (db, wal *FileNode) {
+	file := filepath.Join(dir, "live.db")
+	conn, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetMaxOpenConns(1)
+
+	for _, s := range []string{
+		"create table t (v text)",
+		"insert into t values ('in database')",
+		"PRAGMA journal_mode=WAL",
+		"PRAGMA wal_autocheckpoint=0",
+		"insert into t values ('in log')",
+	} {
+		if _, err := conn.Exec(s); err != nil {
+			t.Fatalf("%s: %v", s, err)
+		}
+	}
+
+	db = &FileNode{inode: nextID(), name: "test.db", overlay: filepath.Join(dir, "test.db")}
+	wal = &FileNode{inode: nextID(), name: "test.db-wal", overlay: filepath.Join(dir, "test.db-wal")}
+	for _, c := range [][2]string{{file, db.overlay}, {file + "-wal", wal.overlay}} {
+		data, err := os.ReadFile(c[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(c[1], data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, wal
+}
+
+// countRows returns the number of rows in the test table of the database in file.
+func countRows(t *testing.T, file string) int {
+	conn, err := openSQLite(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var n int
+	if err := conn.QueryRow("select count(*) from t").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestMergeWAL(t *testing.T) {
+	dir := t.TempDir()
+	db, wal := walDB(t, dir)
+	dst := filepath.Join(dir, "merged.db")
+	if err := mergeWAL(db, wal, dst); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file string
+		rows int
+	}{
+		{db.overlay, 1},
+		{dst, 2},
+	}
+	for _, tt := range tests {
+		if got := countRows(t, tt.file); got != tt.rows {
+			t.Errorf("%s: %d rows, want %d", filepath.Base(tt.file), got, tt.rows)
+		}
+	}
+	for _, f := range []string{dst + "-wal", dst + "-shm"} {
+		if _, err := os.Stat(f); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", filepath.Base(f))
+		}
+	}
+}
+
+func TestAddWALView(t *testing.T) {
+	files := []string{"sms.db", "sms.db-wal", "notes.db", "calls.db", "calls.db-wal", "calls.merged.db"}
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	for _, n := range files {
+		d.entries[n] = &FileNode{inode: nextID(), name: n}
+	}
+	if err := addWALView(d); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		virtual bool
+	}{
+		{"sms.merged.db", true},
+		{"notes.merged.db", false},
+		{"calls.merged.db", false},
+	}
+	for _, tt := range tests {
+		_, virtual := d.entries[tt.name].(*VirtualNode)
+		if virtual != tt.virtual {
+			t.Errorf("%s: snapshot = %v, want %v", tt.name, virtual, tt.virtual)
+		}
+	}
+	if len(d.entries) != len(files)+1 {
+		t.Errorf("%d entries, want %d", len(d.entries), len(files)+1)
+	}
+}
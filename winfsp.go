@@ -5,6 +5,7 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"strings"
 	"sync"
@@ -34,10 +35,6 @@ func mount(mountpoint string) (err error) {
 	return nil
 }
 
-func split(path string) []string {
-	return strings.Split(path, "/")
-}
-
 type FS struct {
 	sync.Mutex
 	*fuse.FileSystemBase
@@ -49,15 +46,31 @@ type FS struct {
 type FSNode struct {
 	NodeEntry
 	stat    fuse.Stat_t
-	fh      *os.File
+	fh      io.ReadSeekCloser
 	opencnt int
+
+	// Set when fh is open for writing
+	rw bool
+	// Set when the file is deleted while open
+	unlinked bool
+}
+
+// refresh updates the size and times of a file after it has been changed.
+func (n *FSNode) refresh() {
+	if file, ok := n.NodeEntry.(FileEntry); ok {
+		if info, err := file.Stat(); err == nil {
+			t := fuse.NewTimespec(info.ModTime())
+			n.stat.Size = info.Size()
+			n.stat.Blocks = (info.Size() + 511) / 512
+			n.stat.Mtim = t
+			n.stat.Ctim = t
+		}
+	}
 }
 
 func newFSFileNode(e NodeEntry, uid, gid uint32) *FSNode {
 
-	file := e.Fullname()
-
-	if info, err := os.Stat(file); err == nil {
+	if info, err := e.(FileEntry).Stat(); err == nil {
 
 		Size := int64(info.Size())
 		Blocks := int64((Size + 511) / 512)
@@ -113,10 +126,10 @@ func newFSDirNode(e NodeEntry, uid, gid uint32) *FSNode {
 func newFSNode(e NodeEntry, uid, gid uint32) *FSNode {
 
 	switch e.(type) {
-	case *FileNode:
-		return newFSFileNode(e, uid, gid)
 	case *DirNode:
 		return newFSDirNode(e, uid, gid)
+	case FileEntry:
+		return newFSFileNode(e, uid, gid)
 	}
 	return nil
 }
@@ -128,19 +141,7 @@ func (fs *FS) makeNode(e NodeEntry) *FSNode {
 
 func (fs *FS) lookupNode(path string) *FSNode {
 	debug("FS:LookupNode Called: %s", path)
-	e := fs.root.NodeEntry
-
-	for _, c := range split(path) {
-		if c != "" {
-			switch e.(type) {
-			case *DirNode:
-				e = e.(*DirNode).entries[c]
-			default:
-				//fmt.Printf("-- LOOKUP NODE ABORT: %s\n", path)
-				return nil
-			}
-		}
-	}
+	e := lookupPath(fs.root.NodeEntry, path)
 	if e == nil {
 		//fmt.Printf("Lookup returning node-not-found: %s\n", path)
 		return nil
@@ -204,19 +205,134 @@ func (*FS) Mknod(path string, mode uint32, dev uint64) int {
 	return -fuse.ENOSYS
 }
 
-func (*FS) Mkdir(path string, mode uint32) int {
+// lookupParent finds the directory which holds (or would hold) path, along with the name.
+func (fs *FS) lookupParent(path string) (*DirNode, string) {
+	i := strings.LastIndexByte(path, '/')
+	parent, _ := lookupPath(fs.root.NodeEntry, path[:i+1]).(*DirNode)
+	return parent, path[i+1:]
+}
+
+// discard removes the overlay copy of a deleted file.  Open files keep their copy until
+// they are released, and files still found elsewhere in the tree keep it for good.
+func (fs *FS) discard(file *FileNode) {
+	if file.links > 0 {
+		return
+	}
+	if node, open := fs.open[file.Inode()]; open {
+		node.unlinked = true
+		return
+	}
+	file.Discard()
+}
+
+// within reports whether path passes through dir, or any alias of it.
+func (fs *FS) within(path string, dir *DirNode) bool {
+	e := fs.root.NodeEntry
+	for _, c := range strings.Split(path, "/") {
+		if c == "" {
+			continue
+		}
+		d, ok := e.(*DirNode)
+		if !ok {
+			return false
+		}
+		e = d.Lookup(c)
+		if sub, ok := e.(*DirNode); ok && sub.base() == dir.base() {
+			return true
+		}
+	}
+	return false
+}
+
+// writable checks changes are allowed, by way of the overlay.
+func writable() int {
+	if global.Overlay == "" {
+		return -fuse.EROFS
+	}
+	return 0
+}
+
+func (fs *FS) Mkdir(path string, mode uint32) int {
 	debug("FS:Mkdir Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc
+	}
+
+	parent, name := fs.lookupParent(path)
+	if parent == nil {
+		return -fuse.ENOENT
+	}
+	if parent.Lookup(name) != nil {
+		return -fuse.EEXIST
+	}
+	parent.Insert(name, &DirNode{
+		inode:   nextID(),
+		name:    name,
+		domain:  parent.domain,
+		entries: make(map[string]NodeEntry),
+	})
+	return 0
 }
 
-func (*FS) Unlink(path string) int {
+func (fs *FS) Unlink(path string) int {
 	debug("FS:Unlink Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc
+	}
+
+	parent, name := fs.lookupParent(path)
+	if parent == nil {
+		return -fuse.ENOENT
+	}
+	key, e := parent.find(name)
+	var file *FileNode
+	switch e := e.(type) {
+	case nil:
+		return -fuse.ENOENT
+	case *DirNode:
+		return -fuse.EISDIR
+	case *FileNode:
+		file = e
+	default:
+		// Files generated by views can not be removed
+		return -fuse.EACCES
+	}
+
+	parent.Remove(key)
+	fs.discard(file)
+	return 0
 }
 
-func (*FS) Rmdir(path string) int {
+func (fs *FS) Rmdir(path string) int {
 	debug("FS:Rmdir Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc
+	}
+
+	parent, name := fs.lookupParent(path)
+	if parent == nil {
+		return -fuse.ENOENT
+	}
+	key, e := parent.find(name)
+	dir, ok := e.(*DirNode)
+	if !ok {
+		if e == nil {
+			return -fuse.ENOENT
+		}
+		return -fuse.ENOTDIR
+	}
+	if len(dir.Entries()) != 0 {
+		return -fuse.ENOTEMPTY
+	}
+
+	parent.Remove(key)
+	return 0
 }
 
 func (*FS) Link(oldpath string, newpath string) int {
@@ -234,9 +350,75 @@ func (*FS) Readlink(path string) (int, string) {
 	return -fuse.ENOSYS, ""
 }
 
-func (*FS) Rename(oldpath string, newpath string) int {
+func (fs *FS) Rename(oldpath string, newpath string) int {
 	debug("FS:Rename Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc
+	}
+
+	from, oldname := fs.lookupParent(oldpath)
+	to, newname := fs.lookupParent(newpath)
+	if from == nil || to == nil {
+		return -fuse.ENOENT
+	}
+	oldkey, e := from.find(oldname)
+	switch e := e.(type) {
+	case nil:
+		return -fuse.ENOENT
+	case *DirNode:
+		// A directory can not be moved below itself
+		if fs.within(newpath[:strings.LastIndexByte(newpath, '/')+1], e) {
+			return -fuse.EINVAL
+		}
+	case *FileNode:
+	default:
+		// Files generated by views can not be moved, as they can not be removed
+		return -fuse.EACCES
+	}
+
+	// Renaming a file to itself does nothing, as rename(2) does, other than changing the case
+	// of the name when the new name was only found ignoring case
+	newkey, existing := to.find(newname)
+	if existing == e {
+		if from.base() != to.base() || newkey == newname {
+			return 0
+		}
+		existing = nil
+	}
+
+	// Replace any existing file, as rename(2) does
+	switch old := existing.(type) {
+	case *FileNode:
+		if _, ok := e.(*DirNode); ok {
+			return -fuse.ENOTDIR
+		}
+		to.Remove(newkey)
+		fs.discard(old)
+	case *DirNode:
+		if _, ok := e.(*DirNode); !ok {
+			return -fuse.EISDIR
+		}
+		if len(old.Entries()) != 0 {
+			return -fuse.ENOTEMPTY
+		}
+		to.Remove(newkey)
+	case nil:
+	default:
+		// Files generated by views can not be replaced either
+		return -fuse.EACCES
+	}
+
+	from.Remove(oldkey)
+	switch n := e.(type) {
+	case *FileNode:
+		n.Rename(newname)
+	case *DirNode:
+		n.Rename(newname)
+	}
+	to.Insert(newname, e)
+	return 0
 }
 
 func (*FS) Chmod(path string, mode uint32) int {
@@ -249,9 +431,30 @@ func (*FS) Chown(path string, uid uint32, gid uint32) int {
 	return -fuse.ENOSYS
 }
 
-func (*FS) Utimens(path string, tmsp []fuse.Timespec) int {
+func (fs *FS) Utimens(path string, tmsp []fuse.Timespec) int {
 	debug("FS:Utimens Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc
+	}
+
+	node := fs.lookupNode(path)
+	if node == nil {
+		return -fuse.ENOENT
+	}
+	file, ok := node.NodeEntry.(*FileNode)
+	if !ok || len(tmsp) < 2 {
+		return 0
+	}
+	if err := file.CopyUp(); err != nil {
+		return -fuse.EIO
+	}
+	if err := os.Chtimes(file.overlay, tmsp[0].Time(), tmsp[1].Time()); err != nil {
+		return -fuse.EIO
+	}
+	node.refresh()
+	return 0
 }
 
 func (*FS) Access(path string, mask uint32) int {
@@ -259,16 +462,35 @@ func (*FS) Access(path string, mask uint32) int {
 	return -fuse.ENOSYS
 }
 
-func (*FS) Create(path string, flags int, mode uint32) (int, uint64) {
+func (fs *FS) Create(path string, flags int, mode uint32) (int, uint64) {
 	debug("FS:Create Called")
-	return -fuse.ENOSYS, ^uint64(0)
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc, ^uint64(0)
+	}
+
+	parent, name := fs.lookupParent(path)
+	if parent == nil {
+		return -fuse.ENOENT, ^uint64(0)
+	}
+	if parent.Lookup(name) == nil {
+		if _, err := parent.CreateFile(name); err != nil {
+			debug("FS:Create failed: %v", err)
+			return -fuse.EIO, ^uint64(0)
+		}
+	} else if flags&fuse.O_EXCL != 0 {
+		return -fuse.EEXIST, ^uint64(0)
+	}
+
+	return fs.openNode(path, false, flags)
 }
 
 func (fs *FS) Open(path string, flags int) (int, uint64) {
 	debug("FS:Open Called")
 	defer fs.Sync()()
 
-	return fs.openNode(path, false)
+	return fs.openNode(path, false, flags)
 }
 
 func (fs *FS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
@@ -286,9 +508,33 @@ func (fs *FS) Getattr(path string, stat *fuse.Stat_t, fh uint64) int {
 	return 0
 }
 
-func (*FS) Truncate(path string, size int64, fh uint64) int {
+func (fs *FS) Truncate(path string, size int64, fh uint64) int {
 	debug("FS:Truncate Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	if errc := writable(); errc != 0 {
+		return errc
+	}
+
+	node := fs.getNode(path, fh)
+	if node == nil {
+		return -fuse.ENOENT
+	}
+	file, ok := node.NodeEntry.(*FileNode)
+	if !ok {
+		if _, ok := node.NodeEntry.(*DirNode); ok {
+			return -fuse.EISDIR
+		}
+		return -fuse.EACCES
+	}
+	if err := file.CopyUp(); err != nil {
+		return -fuse.EIO
+	}
+	if err := os.Truncate(file.overlay, size); err != nil {
+		return -fuse.EIO
+	}
+	node.refresh()
+	return 0
 }
 
 func (fs *FS) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
@@ -298,18 +544,33 @@ func (fs *FS) Read(path string, buff []byte, ofst int64, fh uint64) (n int) {
 	node := fs.getNode(path, fh)
 
 	node.fh.Seek(ofst, os.SEEK_SET)
-	n, _ = node.fh.Read(buff)
+	n, _ = io.ReadFull(node.fh, buff)
 	return
 }
 
-func (*FS) Write(path string, buff []byte, ofst int64, fh uint64) int {
+func (fs *FS) Write(path string, buff []byte, ofst int64, fh uint64) int {
 	debug("FS:Write Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	node := fs.getNode(path, fh)
+	if node == nil {
+		return -fuse.ENOENT
+	}
+	if !node.rw {
+		return -fuse.EBADF
+	}
+
+	n, err := node.fh.(*os.File).WriteAt(buff, ofst)
+	if err != nil {
+		return -fuse.EIO
+	}
+	node.refresh()
+	return n
 }
 
-func (*FS) Flush(path string, fh uint64) int {
+func (fs *FS) Flush(path string, fh uint64) int {
 	debug("FS:Flush Called")
-	return -fuse.ENOSYS
+	return 0
 }
 
 func (fs *FS) Release(path string, fh uint64) int {
@@ -319,9 +580,20 @@ func (fs *FS) Release(path string, fh uint64) int {
 	return fs.closeNode(fh)
 }
 
-func (*FS) Fsync(path string, datasync bool, fh uint64) int {
+func (fs *FS) Fsync(path string, datasync bool, fh uint64) int {
 	debug("FS:Fsync Called")
-	return -fuse.ENOSYS
+	defer fs.Sync()()
+
+	node := fs.getNode(path, fh)
+	if node == nil {
+		return -fuse.ENOENT
+	}
+	if f, ok := node.fh.(*os.File); ok {
+		if err := f.Sync(); err != nil {
+			return -fuse.EIO
+		}
+	}
+	return 0
 }
 
 /*
@@ -331,7 +603,7 @@ func (*FS) Lock(path string, cmd int, lock *Lock_t, fh uint64) int {
 }
 */
 
-func (fs *FS) openNode(path string, isdir bool) (errc int, fh uint64) {
+func (fs *FS) openNode(path string, isdir bool, flags int) (errc int, fh uint64) {
 
 	var err error
 	node := fs.lookupNode(path)
@@ -340,20 +612,48 @@ func (fs *FS) openNode(path string, isdir bool) (errc int, fh uint64) {
 		return -fuse.ENOENT, ^uint64(0)
 	}
 
-	if 0 == node.opencnt {
-		if !isdir {
-			fn := node.NodeEntry.(*FileNode).Fullname()
-			//fmt.Printf("Calling OS.OPEN on %s\n", fn)
-			node.fh, err = os.Open(fn)
+	write := !isdir && flags&fuse.O_ACCMODE != fuse.O_RDONLY
+	if write {
+		if errc := writable(); errc != 0 {
+			return errc, ^uint64(0)
+		}
+	}
+
+	// Generated files can not be changed
+	file, _ := node.NodeEntry.(*FileNode)
+	if write && file == nil {
+		return -fuse.EACCES, ^uint64(0)
+	}
+
+	// All handles share one file, which is reopened for writing (from the overlay) when needed
+	if !isdir && (0 == node.opencnt || write) {
+		if !node.rw || 0 == node.opencnt {
+			var fh io.ReadSeekCloser
+			if file != nil && (write || file.overlay != "") {
+				fh, err = file.OpenWrite()
+			} else {
+				//fmt.Printf("Calling OPEN on %s\n", node.Fullname())
+				fh, err = node.NodeEntry.(FileEntry).Open()
+			}
 			if err != nil {
 				fmt.Printf("RETURNING TOTAL FAILURE\n")
 				return -fuse.EIO, ^uint64(0)
 			}
+			if node.fh != nil {
+				node.fh.Close()
+			}
+			node.fh = fh
+			node.rw = file != nil && (write || file.overlay != "")
+		}
+		if write && flags&fuse.O_TRUNC != 0 {
+			node.fh.(*os.File).Truncate(0)
+			node.refresh()
 		}
-		fs.open[node.stat.Ino] = node
-		node.opencnt++
 	}
 
+	fs.open[node.stat.Ino] = node
+	node.opencnt++
+
 	return 0, node.stat.Ino
 }
 
@@ -364,8 +664,17 @@ func (fs *FS) closeNode(fh uint64) int {
 			node.opencnt--
 		}
 		if 0 == node.opencnt {
-			fs.open[fh].fh.Close()
+			if node.fh != nil {
+				node.fh.Close()
+				node.fh = nil
+				node.rw = false
+			}
 			delete(fs.open, fh)
+
+			// Discard the overlay copy of a file deleted while it was open
+			if file, ok := node.NodeEntry.(*FileNode); ok && node.unlinked {
+				file.Discard()
+			}
 		}
 		return 0
 	}
@@ -376,7 +685,7 @@ func (fs *FS) Opendir(path string) (int, uint64) {
 	debug("FS:Opendir Called")
 	defer fs.Sync()()
 
-	err, fh := fs.openNode(path, true)
+	err, fh := fs.openNode(path, true, 0)
 	return err, fh
 }
 
@@ -388,13 +697,13 @@ func (fs *FS) Readdir(path string,
 	defer fs.Sync()()
 
 	node := fs.getNode(path, fh)
-	e := node.NodeEntry.(*DirNode).entries
+	e := node.NodeEntry.(*DirNode).Entries()
 	for i := range e {
 		s := new(fuse.Stat_t)
 		switch e[i].(type) {
 		case *DirNode:
 			s.Mode = 0744 | fuse.S_IFDIR
-		case *FileNode:
+		default:
 			s.Mode = 0644
 		}
 
@@ -427,10 +736,13 @@ var xattr map[string]int = map[string]int{
 	"user.iphone.file":   0,
 	"user.iphone.id":     1,
 	"user.iphone.domain": 2,
+	"user.iphone.name":   3,
 }
 
 func (fs *FS) Getxattr(path string, name string) (int, []byte) {
 	debug("FS:Getxattr Called: [%s] [%s]", path, name)
+	defer fs.Sync()()
+
 	if id, ok := xattr[name]; ok {
 		node := fs.lookupNode(path)
 		if node == nil {
@@ -443,6 +755,8 @@ func (fs *FS) Getxattr(path string, name string) (int, []byte) {
 			return 0, []byte(node.ID())
 		case 2:
 			return 0, []byte(node.Domain())
+		case 3:
+			return 0, []byte(node.Original())
 		}
 	}
 	return -fuse.ENOSYS, nil
@@ -455,6 +769,8 @@ func (*FS) Removexattr(path string, name string) int {
 
 func (fs *FS) Listxattr(path string, fill func(name string) bool) int {
 	debug("FS:Listxattr Called [%s]", path)
+	defer fs.Sync()()
+
 	node := fs.lookupNode(path)
 	if node == nil {
 		debug("FS:Listxattr returning not-found")
@@ -462,7 +778,7 @@ func (fs *FS) Listxattr(path string, fill func(name string) bool) int {
 	}
 	switch node.NodeEntry.(type) {
 	case *DirNode:
-		if !fill("user.iphone.domain") {
+		if !fill("user.iphone.domain") || !fill("user.iphone.name") {
 			return -fuse.ERANGE
 		}
 		return 0
@@ -472,6 +788,10 @@ func (fs *FS) Listxattr(path string, fill func(name string) bool) int {
 				return -fuse.ERANGE
 			}
 		}
+	case *VirtualNode:
+		if !fill("user.iphone.domain") || !fill("user.iphone.name") {
+			return -fuse.ERANGE
+		}
 	}
 	return 0
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strings"
+)
+
+// Sidecars are named after the photo without its extension (eg: IMG_0001.xmp), as expected
+// by Lightroom and digiKam.
+const xmpExt = ".xmp"
+
+// photoMeta is the metadata of an asset kept in the library rather than the file.
+type photoMeta struct {
+	title    string
+	caption  string
+	keywords []string
+	people   []string
+}
+
+// addXMPView adds an XMP sidecar next to each photo and video of the camera roll mounted
+// from the backup.  Photos/ gains its own sidecars when populated.
+func addXMPView(root *DirNode) error {
+	file, err := backupDB(root, photosDomain, photosPath)
+	if err != nil {
+		debug("XMP sidecars: %v", err)
+		return nil
+	}
+	db, err := openSQLite(file)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	assets, err := readAssets(db)
+	if err != nil {
+		return err
+	}
+	meta := readPhotoMeta(db)
+
+	ids, err := global.db.FileIDs(photosDomain, "Media/%")
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*photoAsset)
+	for _, a := range assets {
+		if id, ok := ids[a.path()]; ok {
+			byID[id] = a
+		}
+	}
+
+	walkFiles(root, func(dir *DirNode, name string, f *FileNode) {
+		if a, ok := byID[f.id]; ok && f.domain == photosDomain {
+			addSidecar(dir, name, a, meta[a.id])
+		}
+	})
+	return nil
+}
+
+// addSidecar adds the sidecar for the file with the given name, unless it already has one
+// (as the photo and video of a Live Photo share theirs).
+func addSidecar(dir *DirNode, name string, a *photoAsset, m *photoMeta) {
+	name = strings.TrimSuffix(name, path.Ext(name)) + xmpExt
+	if _, ok := dir.entries[name]; ok {
+		return
+	}
+	dir.entries[name] = newVirtualWriter(name, photosDomain, func(w io.Writer) error {
+		return writeXMP(w, a, m)
+	})
+}
+
+// readPhotoMeta reads the titles, captions, keywords and people of assets, keyed by asset.
+// Each is read separately, as older libraries lack some of them.
+func readPhotoMeta(db *sql.DB) map[int64]*photoMeta {
+	meta := make(map[int64]*photoMeta)
+	get := func(id int64) *photoMeta {
+		if meta[id] == nil {
+			meta[id] = &photoMeta{}
+		}
+		return meta[id]
+	}
+	read := func(what, query string, fn func(id int64, value string)) {
+		r, err := db.Query(query)
+		if err != nil {
+			debug("Photo %s: %v", what, err)
+			return
+		}
+		defer r.Close()
+		for r.Next() {
+			var id int64
+			var value string
+			if err := r.Scan(&id, &value); err != nil {
+				debug("Photo %s: %v", what, err)
+				return
+			}
+			fn(id, value)
+		}
+	}
+
+	read("titles", `select ZASSET, ZTITLE from ZADDITIONALASSETATTRIBUTES where ZTITLE <> ''`,
+		func(id int64, v string) { get(id).title = v })
+	read("captions", `select a.ZASSET, d.ZLONGDESCRIPTION from ZASSETDESCRIPTION d
+		join ZADDITIONALASSETATTRIBUTES a on a.Z_PK = d.ZASSETATTRIBUTES where d.ZLONGDESCRIPTION <> ''`,
+		func(id int64, v string) { get(id).caption = v })
+
+	if join, attrCol, keywordCol, err := joinTable(db, "ASSETATTRIBUTES", "KEYWORDS"); err == nil {
+		read("keywords", `select a.ZASSET, k.ZTITLE from `+quoteIdent(join)+` j
+			join ZADDITIONALASSETATTRIBUTES a on a.Z_PK = j.`+quoteIdent(attrCol)+`
+			join ZKEYWORD k on k.Z_PK = j.`+quoteIdent(keywordCol)+` where k.ZTITLE <> '' order by k.ZTITLE`,
+			func(id int64, v string) { get(id).keywords = append(get(id).keywords, v) })
+	} else {
+		debug("Photo keywords: %v", err)
+	}
+
+	// Faces were linked to assets and people by other columns before iOS 14
+	asset, person := "ZASSET", "ZPERSON"
+	if hasColumn(db, "ZDETECTEDFACE", "ZASSETFORFACE") {
+		asset, person = "ZASSETFORFACE", "ZPERSONFORFACE"
+	}
+	read("people", `select distinct f.`+asset+`, coalesce(nullif(p.ZFULLNAME,''), p.ZDISPLAYNAME) n
+		from ZDETECTEDFACE f join ZPERSON p on p.Z_PK = f.`+person+` where n <> '' order by n`,
+		func(id int64, v string) { get(id).people = append(get(id).people, v) })
+	return meta
+}
+
+// xmpEscape escapes text for XML.
+func xmpEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xmpCoordinate formats a latitude or longitude as XMP does (eg: "48,51.504000N").
+func xmpCoordinate(v float64, pos, neg string) string {
+	ref := pos
+	if v < 0 {
+		v, ref = -v, neg
+	}
+	deg := math.Floor(v)
+	return fmt.Sprintf("%d,%.6f%s", int(deg), (v-deg)*60, ref)
+}
+
+// writeXMP writes an XMP sidecar holding the date, title, caption, keywords, people and
+// location of the asset, with favorites rated 5 stars.
+func writeXMP(w io.Writer, a *photoAsset, m *photoMeta) error {
+	if m == nil {
+		m = &photoMeta{}
+	}
+	var b strings.Builder
+	date := a.date.Format("2006-01-02T15:04:05-07:00")
+
+	b.WriteString("<?xpacket begin=\"\uFEFF\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"\n")
+	b.WriteString("    xmlns:photoshop=\"http://ns.adobe.com/photoshop/1.0/\"\n")
+	b.WriteString("    xmlns:exif=\"http://ns.adobe.com/exif/1.0/\"\n")
+	b.WriteString("    xmlns:Iptc4xmpExt=\"http://iptc.org/std/Iptc4xmpExt/2008-02-29/\"\n")
+	fmt.Fprintf(&b, "    xmp:CreateDate=%q\n", date)
+	fmt.Fprintf(&b, "    photoshop:DateCreated=%q", date)
+	if a.favorite {
+		b.WriteString("\n    xmp:Rating=\"5\"")
+	}
+	if a.lat != noLocation && a.lon != noLocation {
+		b.WriteString("\n    exif:GPSVersionID=\"2.2.0.0\"")
+		fmt.Fprintf(&b, "\n    exif:GPSLatitude=%q", xmpCoordinate(a.lat, "N", "S"))
+		fmt.Fprintf(&b, "\n    exif:GPSLongitude=%q", xmpCoordinate(a.lon, "E", "W"))
+	}
+	b.WriteString(">\n")
+
+	alt := func(tag, value string) {
+		if value != "" {
+			fmt.Fprintf(&b, "   <%s>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">%s</rdf:li>\n    </rdf:Alt>\n   </%s>\n",
+				tag, xmpEscape(value), tag)
+		}
+	}
+	bag := func(tag string, values []string) {
+		if len(values) > 0 {
+			fmt.Fprintf(&b, "   <%s>\n    <rdf:Bag>\n", tag)
+			for _, v := range values {
+				fmt.Fprintf(&b, "     <rdf:li>%s</rdf:li>\n", xmpEscape(v))
+			}
+			fmt.Fprintf(&b, "    </rdf:Bag>\n   </%s>\n", tag)
+		}
+	}
+	alt("dc:title", m.title)
+	alt("dc:description", m.caption)
+	bag("dc:subject", m.keywords)
+	bag("Iptc4xmpExt:PersonInImage", m.people)
+
+	b.WriteString("  </rdf:Description>\n </rdf:RDF>\n</x:xmpmeta>\n<?xpacket end=\"w\"?>\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestXMPCoordinate(t *testing.T) {
+	tests := []struct {
+		v        float64
+		pos, neg string
+		want     string
+	}{
+		{48.8584, "N", "S", "48,51.504000N"},
+		{-33.8568, "N", "S", "33,51.408000S"},
+		{2.2945, "E", "W", "2,17.670000E"},
+		{-0.1276, "E", "W", "0,7.656000W"},
+		{0, "N", "S", "0,0.000000N"},
+		{-180, "E", "W", "180,0.000000W"},
+	}
+	for _, tt := range tests {
+		if got := xmpCoordinate(tt.v, tt.pos, tt.neg); got != tt.want {
+			t.Errorf("xmpCoordinate(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestWriteXMP(t *testing.T) {
+	date := time.Date(2020, 1, 6, 10, 40, 0, 0, time.FixedZone("", 9*3600))
+
+	tests := []struct {
+		name    string
+		asset   photoAsset
+		meta    *photoMeta
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "no metadata",
+			asset: photoAsset{date: date, lat: noLocation, lon: noLocation},
+			want: []string{
+				`xmp:CreateDate="2020-01-06T10:40:00+09:00"`,
+				`photoshop:DateCreated="2020-01-06T10:40:00+09:00">`,
+			},
+			notWant: []string{"xmp:Rating", "exif:GPS", "dc:title", "dc:description", "dc:subject", "PersonInImage>"},
+		},
+		{
+			name:  "utc",
+			asset: photoAsset{date: date.UTC(), lat: noLocation, lon: noLocation},
+			want:  []string{`xmp:CreateDate="2020-01-06T01:40:00+00:00"`},
+		},
+		{
+			name:  "everything",
+			asset: photoAsset{date: date, favorite: true, lat: 48.8584, lon: -0.1276},
+			meta: &photoMeta{title: "Paris & <friends>", caption: "Day one", keywords: []string{"travel", "france"},
+				people: []string{"Alice", "Bob"}},
+			want: []string{
+				`xmp:Rating="5"`,
+				`exif:GPSLatitude="48,51.504000N"`,
+				`exif:GPSLongitude="0,7.656000W"`,
+				"<dc:title>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">Paris &amp; &lt;friends&gt;</rdf:li>",
+				"<dc:description>\n    <rdf:Alt>\n     <rdf:li xml:lang=\"x-default\">Day one</rdf:li>",
+				"<dc:subject>\n    <rdf:Bag>\n     <rdf:li>travel</rdf:li>\n     <rdf:li>france</rdf:li>\n    </rdf:Bag>",
+				"<Iptc4xmpExt:PersonInImage>\n    <rdf:Bag>\n     <rdf:li>Alice</rdf:li>\n     <rdf:li>Bob</rdf:li>",
+			},
+		},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		if err := writeXMP(&b, &tt.asset, tt.meta); err != nil {
+			t.Fatal(err)
+		}
+		out := b.String()
+		for _, w := range tt.want {
+			if !strings.Contains(out, w) {
+				t.Errorf("%s: %q not found in\n%s", tt.name, w, out)
+			}
+		}
+		for _, w := range tt.notWant {
+			if strings.Contains(out, w) {
+				t.Errorf("%s: %q found in\n%s", tt.name, w, out)
+			}
+		}
+
+		d := xml.NewDecoder(strings.NewReader(out))
+		for {
+			if _, err := d.Token(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("%s: not well formed: %v", tt.name, err)
+				break
+			}
+		}
+	}
+}
+
+func TestAddSidecar(t *testing.T) {
+	d := &DirNode{inode: nextID(), entries: make(map[string]NodeEntry)}
+	d.entries["IMG_0003.xmp"] = &FileNode{name: "IMG_0003.xmp"}
+	a := &photoAsset{}
+
+	tests := []struct {
+		file    string
+		sidecar string
+		virtual bool
+	}{
+		{"IMG_0001.HEIC", "IMG_0001.xmp", true},
+		{"IMG_0001.MOV", "IMG_0001.xmp", true},
+		{"IMG_0002.live.MOV", "IMG_0002.live.xmp", true},
+		{"IMG_0003.JPG", "IMG_0003.xmp", false},
+	}
+	for _, tt := range tests {
+		addSidecar(d, tt.file, a, nil)
+		_, virtual := d.entries[tt.sidecar].(*VirtualNode)
+		if virtual != tt.virtual {
+			t.Errorf("%s: sidecar %s generated = %v, want %v", tt.file, tt.sidecar, virtual, tt.virtual)
+		}
+	}
+	if len(d.entries) != 3 {
+		t.Errorf("%d sidecars, want 3", len(d.entries))
+	}
+}